@@ -0,0 +1,22 @@
+package main
+
+import "time"
+
+// Clock is the scheduler's source of time, so tests can control it.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// clock is the time the scheduler goes by.
+var clock Clock = realClock{}
@@ -0,0 +1,80 @@
+package main
+
+import "time"
+
+// intervalRunner starts an @every job each time its interval elapses,
+// until it is stopped.
+type intervalRunner struct {
+	job   *Job
+	start time.Time // Runs are due a whole number of intervals after this.
+	stop  chan struct{}
+}
+
+// intervalRunners are only used by the scheduler, so need no locking.
+var intervalRunners = make(map[string]*intervalRunner)
+
+// runIntervals stops the current interval runners and runs the @every
+// jobs in jobs instead. A job replacing one of the same name and interval
+// keeps its predecessor's start, so reloading doesn't delay its next run.
+func runIntervals(jobs []*Job, done <-chan struct{}) {
+	old := intervalRunners
+	intervalRunners = make(map[string]*intervalRunner)
+	for _, r := range old {
+		close(r.stop)
+	}
+	now := clock.Now()
+	for _, j := range jobs {
+		if j.Interval == 0 || j.Disabled {
+			continue
+		}
+		r := &intervalRunner{job: j, start: now, stop: make(chan struct{})}
+		var prev *Job
+		if o, ok := old[j.Name]; ok {
+			prev = o.job
+			if o.job.Interval == j.Interval {
+				r.start = o.start
+			}
+		}
+		intervalRunners[j.Name] = r
+		go r.run(prev, done)
+	}
+}
+
+// nextRun is the first time after t that the job is due.
+func (r *intervalRunner) nextRun(t time.Time) time.Time {
+	if t.Before(r.start) {
+		return r.start.Add(r.job.Interval)
+	}
+	n := t.Sub(r.start)/r.job.Interval + 1
+	return r.start.Add(n * r.job.Interval)
+}
+
+func (r *intervalRunner) run(prev *Job, done <-chan struct{}) {
+	j := r.job
+	// Until it exits, the job being replaced counts as the job running.
+	var retired []*Job
+	if prev != nil {
+		retired = []*Job{prev}
+	}
+	next := r.nextRun(clock.Now())
+	for {
+		select {
+		case <-clock.After(next.Sub(clock.Now())):
+		case <-r.stop:
+			return
+		case <-done:
+			return
+		}
+		if readyToDispatch(j, retired) {
+			// Never delay a run past the next one. Drift is measured
+			// from the ideal time, a whole number of intervals after
+			// the start, so late runs never push back later ones.
+			jitter := chooseJitter(j, j.Interval)
+			jitterGauge.WithLabelValues(j.Name).Set(jitter.Seconds())
+			dispatchJob(j, next, 0, jitter, done)
+		}
+		// Runs missed while promcron was suspended, or across a jump of
+		// the clock, are skipped rather than run back to back.
+		next = r.nextRun(clock.Now())
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseEvery(t *testing.T) {
+	jobs, err := ParseJobs("test", "a @every 90s echo  two  spaces\n@seconds\nb @every 6h true\nc 0 * * * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := jobs[0], jobs[1], jobs[2]
+	if a.Interval != 90*time.Second || a.Schedule != "@every 90s" || a.Command != "echo  two  spaces" {
+		t.Fatalf("unexpected interval %s, schedule %q and command %q", a.Interval, a.Schedule, a.Command)
+	}
+	if b.Interval != 6*time.Hour || c.Second == 0 {
+		t.Fatalf("expected @every to ignore @seconds, got %s and %x", b.Interval, c.Second)
+	}
+	now := time.Now()
+	if a.ShouldRunAt(&now) {
+		t.Fatal("expected an @every job not to be scheduled by time of day")
+	}
+	if _, ok := a.NextRun(now, now.Add(time.Hour)); ok {
+		t.Fatal("expected an @every job to have no next run by time of day")
+	}
+
+	for _, tc := range []struct {
+		tab      string
+		expected string
+	}{
+		{"a @every 1x true", "invalid interval"},
+		{"a @every 500ms true", "invalid interval: 500ms is less than a second"},
+		{"a @every 90s", "expected a label, timespec and a command"},
+		{"@keepalive\na @every 1m true", "cannot use both @keepalive and @every"},
+	} {
+		_, err := ParseJobs("test", tc.tab)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("expected an error containing %q parsing %q, got %v", tc.expected, tc.tab, err)
+		}
+	}
+
+	_, err = ParseJobsWithOptions("test", "a @every 30s true", ParseOptions{MinInterval: time.Minute})
+	if err == nil || !strings.Contains(err.Error(), "more often than the minimum interval") {
+		t.Fatalf("expected -min-interval to apply to @every, got %v", err)
+	}
+}
+
+func TestRunIntervals(t *testing.T) {
+	fake := &fakeClock{
+		now:     time.Date(2021, 6, 1, 10, 0, 10, 0, time.UTC),
+		waiting: make(chan time.Duration),
+	}
+	clock = fake
+	defer func() { clock = realClock{} }()
+
+	jobs, err := ParseJobs("test", "every-test @every 90s true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := jobs[0]
+	initJobMetrics(j.Name)
+	defer deleteJobMetrics(j.Name)
+	done := make(chan struct{})
+	runIntervals(jobs, done)
+
+	// Runs are counted from when the job was first scheduled, not
+	// aligned to the clock.
+	if d := <-fake.waiting; d != 90*time.Second {
+		t.Fatalf("expected to wait 90s for the first run, waited %s", d)
+	}
+	fake.Advance(90 * time.Second)
+	if d := <-fake.waiting; d != 90*time.Second {
+		t.Fatalf("expected to wait 90s for the second run, waited %s", d)
+	}
+	j.Wait()
+	if v := testutil.ToFloat64(successCounter.WithLabelValues(j.Name)); v != 1 {
+		t.Fatalf("expected the job to run once, it succeeded %v times", v)
+	}
+	if v := testutil.ToFloat64(scheduleDriftGauge.WithLabelValues(j.Name)); v != 0 {
+		t.Fatalf("expected no drift, got %vs", v)
+	}
+
+	// Reloading the same job keeps its phase.
+	fake.Advance(30 * time.Second)
+	reloaded, err := ParseJobs("test", "every-test @every 90s true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runIntervals(reloaded, done)
+	if d := <-fake.waiting; d != time.Minute {
+		t.Fatalf("expected to wait the rest of the interval after a reload, waited %s", d)
+	}
+
+	// Missed runs are skipped rather than run back to back.
+	fake.Advance(10*time.Minute + 20*time.Second)
+	if d := <-fake.waiting; d != 70*time.Second {
+		t.Fatalf("expected to wait until the next whole interval, waited %s", d)
+	}
+	reloaded[0].Wait()
+	if v := testutil.ToFloat64(successCounter.WithLabelValues(j.Name)); v != 2 {
+		t.Fatalf("expected one run after the jump, it succeeded %v times", v)
+	}
+	// The run was due at 10:03:10 but started at 10:12:30.
+	if v := testutil.ToFloat64(scheduleDriftGauge.WithLabelValues(j.Name)); v != 560 {
+		t.Fatalf("expected the late run to have drifted 560s, got %vs", v)
+	}
+
+	close(done)
+	runIntervals(nil, done)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	monthNames = []string{"", "January", "February", "March", "April", "May", "June",
+		"July", "August", "September", "October", "November", "December"}
+	dayNames = []string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"}
+	ordinals = []string{"", "first", "second", "third", "fourth", "fifth"}
+)
+
+// ExplainSchedule describes a timespec in plain English, such as
+// "every 15 minutes, between 09:00 and 17:59, on Monday through Friday"
+// for "*/15 9-17 * * mon-fri". With seconds the timespec starts with a
+// seconds field, and with dayAnd restricted days of month and week
+// must both match, as for ParseOptions.
+func ExplainSchedule(spec string, seconds, dayAnd bool) (string, error) {
+	fields := strings.Fields(spec)
+	nFields := 5
+	if seconds {
+		nFields = 6
+	}
+	if len(fields) != nFields {
+		return "", fmt.Errorf("expected %d fields, got %d", nFields, len(fields))
+	}
+	_, err := ParseJobsWithOptions("timespec", "explain "+strings.Join(fields, " ")+" true", ParseOptions{Seconds: seconds})
+	if err != nil {
+		// Drop the position and context, which are of the made up job line.
+		msg := strings.SplitN(err.Error(), "\n", 2)[0]
+		msg = strings.TrimPrefix(msg, "parse error ")
+		return "", errors.New(msg[strings.IndexByte(msg, ' ')+1:])
+	}
+	second := ""
+	if seconds {
+		second, fields = fields[0], fields[1:]
+	}
+	minute, hour, dom, month, dow := fields[0], fields[1], fields[2], fields[3], fields[4]
+
+	var parts []string
+	if isNumber(minute) && isNumber(hour) && (second == "" || isNumber(second)) {
+		at := fmt.Sprintf("at %02s:%02s", hour, minute)
+		if second != "" {
+			at += fmt.Sprintf(":%02s", second)
+		}
+		parts = append(parts, at)
+	} else {
+		if second != "" {
+			parts = append(parts, explainField(second, "second", "at second", "at seconds", 59, strconv.Itoa))
+		}
+		switch {
+		case minute == "*" && second != "":
+			// Every second of every minute needs no more words.
+		case isNumber(minute) && hour == "*":
+			parts = append(parts, "at minute "+minute+" past every hour")
+		default:
+			parts = append(parts, explainField(minute, "minute", "at minute", "at minutes", 59, strconv.Itoa))
+		}
+		switch {
+		case hour == "*":
+		case isNumber(hour):
+			parts = append(parts, fmt.Sprintf("between %02s:00 and %02s:59", hour, hour))
+		case isRange(hour):
+			lowAndHigh := strings.Split(hour, "-")
+			parts = append(parts, fmt.Sprintf("between %02s:00 and %02s:59", lowAndHigh[0], lowAndHigh[1]))
+		default:
+			parts = append(parts, explainField(hour, "hour", "during hour", "during hours", 23, strconv.Itoa))
+		}
+	}
+
+	var days []string
+	if dom != "*" && dom != "?" {
+		days = append(days, explainDom(dom))
+	}
+	if dow != "*" && dow != "?" {
+		days = append(days, explainDow(dow))
+	}
+	if len(days) == 2 && !dayAnd && dom[0] != '*' && dow[0] != '*' {
+		parts = append(parts, days[0]+" or "+days[1])
+	} else {
+		parts = append(parts, days...)
+	}
+	if month != "*" {
+		parts = append(parts, explainField(month, "month", "in", "in", 12, func(n int) string { return monthNames[n] }))
+	}
+	return strings.Join(parts, ", "), nil
+}
+
+// explainField describes a comma separated field, naming single values
+// with name and prefixing them with single or plural.
+func explainField(field, unit, single, plural string, max int, name func(int) string) string {
+	if field == "R" || field == "r" || strings.Contains(field, "~") {
+		phrase := strings.TrimSuffix(single, unit) + "a random " + unit
+		if lowAndHigh := strings.Split(field, "~"); len(lowAndHigh) == 2 && field != "~" {
+			low, high := lowAndHigh[0], lowAndHigh[1]
+			if low == "" {
+				low = "0"
+			}
+			if high == "" {
+				high = strconv.Itoa(max)
+			}
+			phrase += " from " + name(fieldValue(low, unit)) + " through " + name(fieldValue(high, unit))
+		}
+		return phrase + " each day"
+	}
+	var values, steps []string
+	for _, expr := range strings.Split(field, ",") {
+		rangeAndStep := strings.Split(expr, "/")
+		lowAndHigh := strings.Split(rangeAndStep[0], "-")
+		var phrase string
+		if lowAndHigh[0] == "*" {
+			phrase = "every " + unit
+		} else {
+			low := name(fieldValue(lowAndHigh[0], unit))
+			switch {
+			case len(lowAndHigh) == 2:
+				phrase = low + " through " + name(fieldValue(lowAndHigh[1], unit))
+			case len(rangeAndStep) == 2:
+				phrase = low + " through " + name(max)
+			default:
+				phrase = low
+			}
+		}
+		if len(rangeAndStep) == 1 && lowAndHigh[0] != "*" {
+			values = append(values, phrase)
+			continue
+		}
+		if len(rangeAndStep) == 2 && rangeAndStep[1] != "1" {
+			step := "every " + rangeAndStep[1] + " " + unit + "s"
+			if lowAndHigh[0] == "*" {
+				phrase = step
+			} else {
+				phrase = step + " from " + phrase
+			}
+		} else if lowAndHigh[0] != "*" {
+			phrase = "every " + unit + " from " + phrase
+		}
+		steps = append(steps, phrase)
+	}
+	var phrases []string
+	switch {
+	case len(values) == 1 && !strings.Contains(values[0], " through "):
+		phrases = append(phrases, single+" "+values[0])
+	case len(values) > 0:
+		phrases = append(phrases, plural+" "+joinList(values))
+	}
+	phrases = append(phrases, steps...)
+	return joinList(phrases)
+}
+
+func explainDom(field string) string {
+	var numbers, fromLast []string
+	for _, expr := range strings.Split(field, ",") {
+		switch {
+		case expr == "L" || expr == "l":
+			fromLast = append(fromLast, "the last day of the month")
+		case expr[0] == 'L' || expr[0] == 'l':
+			n := expr[2:]
+			if n == "1" {
+				fromLast = append(fromLast, "1 day before the last day of the month")
+			} else {
+				fromLast = append(fromLast, n+" days before the last day of the month")
+			}
+		default:
+			numbers = append(numbers, expr)
+		}
+	}
+	var phrases []string
+	if len(numbers) > 0 {
+		phrases = append(phrases, explainField(strings.Join(numbers, ","), "day", "day", "days", 31, strconv.Itoa)+" of the month")
+	}
+	phrases = append(phrases, fromLast...)
+	return onDays(joinList(phrases))
+}
+
+func explainDow(field string) string {
+	var days, nth []string
+	for _, expr := range strings.Split(field, ",") {
+		dayAndN := strings.Split(expr, "#")
+		if len(dayAndN) == 2 {
+			day := fieldValue(dayAndN[0], "day of week")
+			n, _ := strconv.Atoi(dayAndN[1])
+			nth = append(nth, "the "+ordinals[n]+" "+dayNames[day%7]+" of the month")
+			continue
+		}
+		days = append(days, expr)
+	}
+	var phrases []string
+	if len(days) > 0 {
+		phrase := explainField(strings.Join(days, ","), "day", "", "", 6, func(n int) string { return dayNames[n%7] })
+		phrases = append(phrases, strings.TrimSpace(phrase))
+	}
+	phrases = append(phrases, nth...)
+	return onDays(joinList(phrases))
+}
+
+func onDays(days string) string {
+	if strings.HasPrefix(days, "every ") {
+		return days
+	}
+	return "on " + days
+}
+
+// fieldValue is the number of a value already checked by the parser,
+// which may be the name of a month or day of the week.
+func fieldValue(s, unit string) int {
+	names := map[string]map[string]uint{
+		"month":       monthBound.names,
+		"day":         dowBound.names,
+		"day of week": dowBound.names,
+	}[unit]
+	n, err := parseIntOrName(s, names)
+	if err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+func isRange(s string) bool {
+	lowAndHigh := strings.Split(s, "-")
+	return len(lowAndHigh) == 2 && isNumber(lowAndHigh[0]) && isNumber(lowAndHigh[1])
+}
+
+// joinList joins items like "a, b and c".
+func joinList(items []string) string {
+	if len(items) <= 1 {
+		return strings.Join(items, "")
+	}
+	return strings.Join(items[:len(items)-1], ", ") + " and " + items[len(items)-1]
+}
+
+// DumpParsed lists the fields of a parsed job as the raw masks and the
+// values they match, for debugging the parser at a lower level than
+// ExplainSchedule. Masks with starBit set are marked with "*", and
+// the names of random fields, which match one of the values each day,
+// with "R".
+func DumpParsed(j *Job) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\n", j.Name, j.Schedule)
+	if j.Interval != 0 {
+		fmt.Fprintf(&b, "  %-15s %s\n", "every", j.Interval)
+		return b.String()
+	}
+	field := func(name string, mask uint64, r bounds) {
+		values := maskValues(mask, r)
+		if mask&starBit != 0 {
+			values += " *"
+		}
+		fmt.Fprintf(&b, "  %-15s 0x%016x %s\n", name, mask, values)
+	}
+	clockField := func(name string, mask uint64, r bounds, random uint8) {
+		if j.Random&random != 0 {
+			name += " R"
+		}
+		field(name, mask, r)
+	}
+	if j.Second != 0 {
+		clockField("second", j.Second, secondBound, RandomSecond)
+	}
+	clockField("minute", j.Minute, minuteBound, RandomMinute)
+	clockField("hour", j.Hour, hourBound, RandomHour)
+	field("day of month", j.Dom, domBound)
+	if j.DomFromLast != 0 {
+		field("days from last", j.DomFromLast, bounds{0, 30, nil})
+	}
+	field("month", j.Month, monthBound)
+	field("day of week", j.Dow, dowBound)
+	for day, nth := range j.DowNth {
+		if nth != 0 {
+			field("nth "+strings.ToLower(dayNames[day][:3]), uint64(nth), bounds{1, 5, nil})
+		}
+	}
+	if j.DayAnd {
+		fmt.Fprintf(&b, "  %-15s true\n", "day and")
+	}
+	if j.Splay != 0 {
+		fmt.Fprintf(&b, "  %-15s %s\n", "splay", j.Splay)
+	}
+	return b.String()
+}
+
+// maskValues lists the values set in mask within r, joining runs of three
+// or more into ranges, like "0-4,10,20".
+func maskValues(mask uint64, r bounds) string {
+	var values []string
+	for v := r.min; v <= r.max; v++ {
+		if mask&(1<<v) == 0 {
+			continue
+		}
+		end := v
+		for end < r.max && mask&(1<<(end+1)) != 0 {
+			end++
+		}
+		switch {
+		case end-v >= 2:
+			values = append(values, fmt.Sprintf("%d-%d", v, end))
+		case end > v:
+			values = append(values, strconv.Itoa(int(v)), strconv.Itoa(int(end)))
+		default:
+			values = append(values, strconv.Itoa(int(v)))
+		}
+		v = end
+	}
+	if len(values) == 0 {
+		return "none"
+	}
+	return strings.Join(values, ",")
+}
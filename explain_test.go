@@ -0,0 +1,93 @@
+package main
+
+import "testing"
+
+func TestExplainSchedule(t *testing.T) {
+	for _, tc := range []struct {
+		spec     string
+		seconds  bool
+		expected string
+	}{
+		{"*/15 9-17 * * mon-fri", false, "every 15 minutes, between 09:00 and 17:59, on Monday through Friday"},
+		{"0 2 * * *", false, "at 02:00"},
+		{"5 * * * *", false, "at minute 5 past every hour"},
+		{"* * * * *", false, "every minute"},
+		{"0,30 9,17 * * *", false, "at minutes 0 and 30, during hours 9 and 17"},
+		{"0 0 1 * mon", false, "at 00:00, on day 1 of the month or on Monday"},
+		{"0 0 */2 * mon", false, "at 00:00, every 2 days of the month, on Monday"},
+		{"0 9 L-2,15 * *", false, "at 09:00, on day 15 of the month and 2 days before the last day of the month"},
+		{"0 9 * jan-mar mon#1", false, "at 09:00, on the first Monday of the month, in January through March"},
+		{"0-10/2 * * 6/2 *", false, "every 2 minutes from 0 through 10, every 2 months from June through December"},
+		{"0 0 * * 5-7", false, "at 00:00, on Friday through Sunday"},
+		{"0 0 * * 1/2", false, "at 00:00, every 2 days from Monday through Saturday"},
+		{"*/10 * * * * *", true, "every 10 seconds"},
+		{"5 0 9 * * *", true, "at 09:00:05"},
+		{"R 2 * * *", false, "at a random minute each day, between 02:00 and 02:59"},
+		{"0~29 ~ * * *", false, "at a random minute from 0 through 29 each day, during a random hour each day"},
+		{"~ 0 9 * * *", true, "at a random second each day, at minute 0, between 09:00 and 09:59"},
+	} {
+		description, err := ExplainSchedule(tc.spec, tc.seconds, false)
+		if err != nil {
+			t.Fatalf("%q: %s", tc.spec, err)
+		}
+		if description != tc.expected {
+			t.Fatalf("%q: expected %q, got %q", tc.spec, tc.expected, description)
+		}
+	}
+
+	description, err := ExplainSchedule("0 0 1 * mon", false, true)
+	if err != nil || description != "at 00:00, on day 1 of the month, on Monday" {
+		t.Fatalf("unexpected description %q with day-and, %v", description, err)
+	}
+
+	for _, spec := range []string{"* * * *", "x * * * *", "0 24 * * *"} {
+		_, err := ExplainSchedule(spec, false, false)
+		if err == nil {
+			t.Fatalf("expected an error explaining %q", spec)
+		}
+	}
+}
+
+func TestDumpParsed(t *testing.T) {
+	jobs, err := ParseJobs("test", "a 0,15,30,45 2 * * mon-fri true\nb 0 9 L-2,15 jan,mar mon#1 true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `a 0,15,30,45 2 * * mon-fri
+  minute          0x0000200040008001 0,15,30,45
+  hour            0x0000000000000004 2
+  day of month    0x80000000fffffffe 1-31 *
+  month           0x8000000000001ffe 1-12 *
+  day of week     0x000000000000003e 1-5
+`
+	if dump := DumpParsed(jobs[0]); dump != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, dump)
+	}
+	expected = `b 0 9 L-2,15 jan,mar mon#1
+  minute          0x0000000000000001 0
+  hour            0x0000000000000200 9
+  day of month    0x0000000000008000 15
+  days from last  0x0000000000000004 2
+  month           0x000000000000000a 1,3
+  day of week     0x0000000000000000 none
+  nth mon         0x0000000000000002 1
+`
+	if dump := DumpParsed(jobs[1]); dump != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, dump)
+	}
+
+	jobs, err = ParseJobs("test", "c 0~29 R * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `c 0~29 R * * *
+  minute R        0x000000003fffffff 0-29
+  hour R          0x0000000000ffffff 0-23
+  day of month    0x80000000fffffffe 1-31 *
+  month           0x8000000000001ffe 1-12 *
+  day of week     0x800000000000007f 0-6 *
+`
+	if dump := DumpParsed(jobs[0]); dump != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, dump)
+	}
+}
@@ -1,5 +1,20 @@
 module github.com/andrewchambers/promcron
 
-go 1.16
+go 1.20
 
-require github.com/prometheus/client_golang v1.11.0 // indirect
+require (
+	github.com/fsnotify/fsnotify v1.6.0
+	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.26.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/golang/protobuf v1.4.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/procfs v0.6.0 // indirect
+	golang.org/x/sys v0.0.0-20220908164124-27713097b956 // indirect
+	google.golang.org/protobuf v1.26.0-rc.1 // indirect
+)
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	groupRunningGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "promcron_group_running",
+			Help: "Whether a job in the @group is running.",
+		},
+		[]string{"group"},
+	)
+	groupQueuedGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "promcron_group_queued",
+			Help: "Number of jobs waiting for another job in the @group to finish.",
+		},
+		[]string{"group"},
+	)
+)
+
+var (
+	// groupLocksMu guards groupLocks, which are kept across reloads
+	// so jobs from before a reload still exclude those after it.
+	groupLocksMu sync.Mutex
+	groupLocks   = make(map[string]chan struct{})
+)
+
+func groupLock(group string) chan struct{} {
+	groupLocksMu.Lock()
+	defer groupLocksMu.Unlock()
+	lock, ok := groupLocks[group]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		groupLocks[group] = lock
+		groupRunningGauge.WithLabelValues(group)
+		groupQueuedGauge.WithLabelValues(group)
+	}
+	return lock
+}
+
+// acquireGroup takes the lock of the job's @group, if it has one, waiting
+// for the running job in the group to finish if the policy is to queue.
+// It returns false if the job should not be run.
+func acquireGroup(j *Job, done <-chan struct{}) bool {
+	if j.Group == "" {
+		return true
+	}
+	lock := groupLock(j.Group)
+	select {
+	case lock <- struct{}{}:
+		groupRunningGauge.WithLabelValues(j.Group).Set(1)
+		return true
+	default:
+	}
+	if *groupPolicy == "skip" {
+		logEvent("warn", "job_skip", logFields{"job": j.Name, "group": j.Group}, "skipping job %s, another job in group %s is running", j.Name, j.Group)
+		return false
+	}
+	logEvent("info", "job_queue", logFields{"job": j.Name, "group": j.Group}, "queueing job %s until the running job in group %s finishes", j.Name, j.Group)
+	groupQueuedGauge.WithLabelValues(j.Group).Inc()
+	defer groupQueuedGauge.WithLabelValues(j.Group).Dec()
+	select {
+	case lock <- struct{}{}:
+		groupRunningGauge.WithLabelValues(j.Group).Set(1)
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// releaseGroup releases the lock taken by acquireGroup.
+func releaseGroup(j *Job) {
+	if j.Group == "" {
+		return
+	}
+	groupRunningGauge.WithLabelValues(j.Group).Set(0)
+	<-groupLock(j.Group)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGroups(t *testing.T) {
+	defer func(policy string) { *groupPolicy = policy }(*groupPolicy)
+	a := &Job{Name: "a", Group: "test-db"}
+	b := &Job{Name: "b", Group: "test-db"}
+	other := &Job{Name: "other", Group: "test-other"}
+	done := make(chan struct{})
+
+	*groupPolicy = "skip"
+	if !acquireGroup(a, done) {
+		t.Fatal("expected a to run")
+	}
+	if acquireGroup(b, done) {
+		t.Fatal("expected b to be skipped while a runs")
+	}
+	if !acquireGroup(other, done) {
+		t.Fatal("expected a job in another group to run")
+	}
+	releaseGroup(other)
+
+	*groupPolicy = "queue"
+	acquired := make(chan bool)
+	go func() {
+		acquired <- acquireGroup(b, done)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("expected b to wait for a")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if v := testutil.ToFloat64(groupQueuedGauge.WithLabelValues("test-db")); v != 1 {
+		t.Fatalf("expected 1 queued job, got %v", v)
+	}
+	releaseGroup(a)
+	if !<-acquired {
+		t.Fatal("expected b to run once a finished")
+	}
+	if v := testutil.ToFloat64(groupRunningGauge.WithLabelValues("test-db")); v != 1 {
+		t.Fatalf("expected the group to be running, got %v", v)
+	}
+	releaseGroup(b)
+	if v := testutil.ToFloat64(groupRunningGauge.WithLabelValues("test-db")); v != 0 {
+		t.Fatalf("expected the group not to be running, got %v", v)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var heartbeatErrors = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "promcron_heartbeat_errors",
+	Help: "Times notifying a job's @heartbeat URL failed.",
+})
+
+var heartbeatClient = &http.Client{Timeout: 30 * time.Second}
+
+// heartbeatURL returns the URL to notify for a job event, following
+// the healthchecks.io convention of "<url>/start" when a job starts,
+// and "<url>" or "<url>/fail" when it succeeds or fails.
+func heartbeatURL(base, event string, exitStatus int) string {
+	url := strings.TrimRight(base, "/")
+	switch event {
+	case "start":
+		return url + "/start"
+	case "fail":
+		url += "/fail"
+	}
+	return fmt.Sprintf("%s?exit_code=%d", url, exitStatus)
+}
+
+// sendHeartbeat notifies a job's heartbeat URL in the background, once
+// after, if it isn't nil, is closed. The returned channel is closed
+// once the notification has been sent or has failed.
+func sendHeartbeat(jobName, url string, after <-chan struct{}) <-chan struct{} {
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		if after != nil {
+			<-after
+		}
+		resp, err := heartbeatClient.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("unexpected status %s", resp.Status)
+			}
+		}
+		if err != nil {
+			log.Printf("error sending heartbeat for job %s: %s", jobName, err)
+			heartbeatErrors.Inc()
+		}
+	}()
+	return sent
+}
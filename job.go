@@ -1,68 +1,668 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math/bits"
 	"os"
 	"os/exec"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type Job struct {
-	Name    string
-	Command string
-	Minute  uint64
-	Hour    uint64
-	Dom     uint64
-	Month   uint64
-	Dow     uint64
-	wg      sync.WaitGroup
-	child   *exec.Cmd
-	running int32
+	Name          string
+	Command       string
+	Schedule      string // The timespec as written.
+	Description   string // From "# desc:" comments before the job.
+	Second        uint64 // Zero for jobs without a seconds field.
+	Minute        uint64
+	Hour          uint64
+	Dom           uint64
+	DomFromLast   uint64 // Bit N set runs N days before the last day of the month.
+	Month         uint64
+	Dow           uint64
+	DowNth        [7]uint8 // Bit N of DowNth[D] set runs on the Nth weekday D of the month.
+	Env           []string // Extra "KEY=VALUE" environment variables.
+	EnvFile       string   // Read for more variables before each run, which Env overrides.
+	MaxJitter     time.Duration
+	Retries       int           // Times to retry a failed run.
+	RetryBackoff  time.Duration // Wait before the first retry, doubling each time.
+	LogFile       string        // Append output here instead of stderr when set.
+	Stdout        string        // Where stdout goes, a path or one of the Output destinations, empty for the usual output.
+	Stderr        string        // Where stderr goes, like Stdout.
+	LogTimestamps bool          // Prefix each line of output with the time.
+	PrefixOutput  bool          // Prefix each line of output with the job name.
+	Overlap       string        // What to do when due while still running, empty to skip.
+	Heartbeat     string        // URL to notify when the job starts and finishes.
+	OnSuccess     string        // Command to run after the job succeeds.
+	OnFailure     string        // Command to run after the job fails.
+	Nice          int           // Niceness to run at, zero to inherit promcron's.
+	IOClass       int           // I/O scheduling class, zero to inherit promcron's.
+	IOLevel       int           // Priority within IOClass, from 0 to 7.
+	OutputLimit   int64         // Bytes of output to keep from each run, zero for no limit.
+	Disabled      bool          // Never scheduled, but still parsed and exported.
+	DayAnd        bool          // Require both Dom and Dow to match, even when both are restricted.
+	Exec          bool          // Run Args directly rather than Command with /bin/sh.
+	Args          []string      // Command split into arguments, when Exec is set.
+	MaxDuration   time.Duration // Runs taking longer are logged and counted as slow, zero for no limit.
+	Group         string        // Never run while another job in the same group is running.
+	Requires      string        // Only run if the last run of the job with this name succeeded.
+	SkipIfExists  string        // Skip runs while a file exists at this path.
+	RunIfExists   string        // Skip runs unless a file exists at this path.
+	OverdueAfter  time.Duration // Only count as overdue once a run has taken this long.
+	Timeout       time.Duration // Kill runs taking longer than this, zero for no limit.
+	Splay         time.Duration // How much later than its schedule the job runs, under an hour.
+	KeepAlive     bool          // Never scheduled, instead restarted whenever it exits.
+	Interval      time.Duration // For @every, run at this interval rather than on the timespec, which is empty.
+	Random        uint8         // Fields that match one value from their mask picked each day, see RandomSecond.
+	RandomSeed    string        // Hashed with the name and date to pick the values of Random fields.
+	splay         bool          // Set by @splay, until Splay is picked.
+	wg            sync.WaitGroup
+	childMu       sync.Mutex // Guards children, queued and changes to running.
+	children      map[*exec.Cmd]struct{}
+	queued        bool
+	running       int32
+	runStart      time.Time // When the latest run started, zero if none is running.
 }
 
+// Flags for Job.Random, one for each field that can be "R" or "A~B".
+const (
+	RandomSecond uint8 = 1 << iota
+	RandomMinute
+	RandomHour
+)
+
+// outputWaitDelay is how long a run waits, once its command exits, for
+// processes it left in the background to close the output pipe.
+const outputWaitDelay = time.Second
+
+// Output destinations for @stdout and @stderr, besides a file path.
+const (
+	OutputStdout  = "stdout"  // promcron's stdout.
+	OutputStderr  = "stderr"  // promcron's stderr, even with @log.
+	OutputDiscard = "discard" // Nowhere.
+)
+
+// Overlap policies, for when a job is due while it is still running.
+const (
+	OverlapSkip     = "skip"     // Skip the run.
+	OverlapQueue    = "queue"    // Run again once the current run finishes.
+	OverlapParallel = "parallel" // Run alongside the current run.
+)
+
+// ShouldRunAt reports whether the job is due at t. The answer depends
+// only on the job and t, never on the clock or on earlier calls, so
+// NextRun, -print-schedule and tests can ask about any time in any order.
+// New features must keep it that way: anything picked per day, like the
+// values of random fields, is derived from the date by DayMasks rather
+// than stored on the job as days pass.
 func (j *Job) ShouldRunAt(t *time.Time) bool {
-	if (1 << uint(t.Minute()) & j.Minute) == 0 {
+	if j.Disabled || j.KeepAlive || j.Interval != 0 {
 		return false
 	}
-	if (1 << uint(t.Hour()) & j.Hour) == 0 {
+	if j.Second != 0 {
+		second, _, _ := j.DayMasks(j.scheduledAt(*t))
+		if (1 << uint(t.Second()) & second) == 0 {
+			return false
+		}
+	}
+	return j.shouldRunInMinute(t)
+}
+
+// shouldRunInMinute is ShouldRunAt ignoring the seconds field.
+func (j *Job) shouldRunInMinute(t *time.Time) bool {
+	scheduled := j.scheduledAt(*t)
+	t = &scheduled
+	_, minute, hour := j.DayMasks(scheduled)
+	if (1 << uint(t.Minute()) & minute) == 0 {
 		return false
 	}
+	if (1 << uint(t.Hour()) & hour) == 0 {
+		return false
+	}
+	return j.runsOnDay(t)
+}
+
+// scheduledAt is the time in the job's schedule that running at t
+// corresponds to, earlier than t by any splay.
+func (j *Job) scheduledAt(t time.Time) time.Time {
+	return t.Add(-j.Splay)
+}
+
+// DayMasks returns the second, minute and hour masks the job matches on
+// the day of t. They are the parsed masks, except that each field in
+// j.Random has only the bit of the value picked for that day, by hashing
+// the seed, name, date and field. The same day always gives the same
+// masks, so nothing needs refreshing as days pass, and tests can check
+// the picks directly.
+func (j *Job) DayMasks(t time.Time) (second, minute, hour uint64) {
+	second, minute, hour = j.Second, j.Minute, j.Hour
+	if j.Random == 0 {
+		return second, minute, hour
+	}
+	date := t.Format("2006-01-02")
+	if j.Random&RandomSecond != 0 {
+		second = j.pick(date, RandomSecond, second)
+	}
+	if j.Random&RandomMinute != 0 {
+		minute = j.pick(date, RandomMinute, minute)
+	}
+	if j.Random&RandomHour != 0 {
+		hour = j.pick(date, RandomHour, hour)
+	}
+	return second, minute, hour
+}
+
+// pick returns the mask with only one of the bits set in mask, chosen
+// by hashing the job's seed and name with the date and field.
+func (j *Job) pick(date string, field uint8, mask uint64) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(j.RandomSeed))
+	h.Write([]byte{0})
+	h.Write([]byte(j.Name))
+	h.Write([]byte{0})
+	h.Write([]byte(date))
+	h.Write([]byte{0, field})
+	n := h.Sum64() % uint64(bits.OnesCount64(mask))
+	for v := uint(0); ; v++ {
+		if mask&(1<<v) == 0 {
+			continue
+		}
+		if n == 0 {
+			return 1 << v
+		}
+		n--
+	}
+}
+
+// runsOnDay reports whether the job runs at some time on the day of t.
+func (j *Job) runsOnDay(t *time.Time) bool {
 	if (1 << uint(t.Month()) & j.Month) == 0 {
 		return false
 	}
 	domMatch := (1 << uint(t.Day()) & j.Dom) > 0
+	if j.DomFromLast != 0 {
+		lastDay := time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, t.Location()).Day()
+		domMatch = domMatch || (1<<uint(lastDay-t.Day())&j.DomFromLast) > 0
+	}
 	dowMatch := (1 << uint(t.Weekday()) & j.Dow) > 0
-	if j.Dom&starBit > 0 || j.Dow&starBit > 0 {
+	if j.DowNth[t.Weekday()] != 0 {
+		nth := (t.Day()-1)/7 + 1
+		dowMatch = dowMatch || (1<<uint(nth)&j.DowNth[t.Weekday()]) > 0
+	}
+	if j.DayAnd || j.Dom&starBit > 0 || j.Dow&starBit > 0 {
 		return domMatch && dowMatch
 	}
 	return domMatch || dowMatch
 }
 
+// NextRun returns the first time after from that the job is scheduled to
+// run, or false if it isn't scheduled before end.
+func (j *Job) NextRun(from, end time.Time) (time.Time, bool) {
+	if j.Disabled || j.KeepAlive || j.Interval != 0 {
+		return time.Time{}, false
+	}
+	for t := from.Truncate(time.Minute); t.Before(end); t = t.Add(time.Minute) {
+		if !j.shouldRunInMinute(&t) {
+			continue
+		}
+		if j.Second == 0 {
+			if t.After(from) {
+				return t, true
+			}
+			continue
+		}
+		for s := t; s.Before(t.Add(time.Minute)); s = s.Add(time.Second) {
+			if s.After(from) && s.Before(end) && j.ShouldRunAt(&s) {
+				return s, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// ShortestInterval simulates up to the given number of runs of the job
+// after from, within a year, and returns the shortest time between two
+// consecutive runs, or zero if it doesn't run at least twice.
+func (j *Job) ShortestInterval(from time.Time, runs int) time.Duration {
+	end := from.AddDate(1, 0, 0)
+	var shortest time.Duration
+	prev, ok := j.NextRun(from, end)
+	for i := 1; ok && i < runs; i++ {
+		var next time.Time
+		next, ok = j.NextRun(prev, end)
+		if ok && (shortest == 0 || next.Sub(prev) < shortest) {
+			shortest = next.Sub(prev)
+		}
+		prev = next
+	}
+	return shortest
+}
+
+// CanRun reports whether there is any day the job could run on,
+// ignoring whether it is disabled.
+func (j *Job) CanRun() bool {
+	// The calendar repeats every 28 years between 1901 and 2099,
+	// so these include every date falling on every weekday.
+	start := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for d := start; d.Year() < 2028; d = d.AddDate(0, 0, 1) {
+		if j.runsOnDay(&d) {
+			return true
+		}
+	}
+	return false
+}
+
 func (j *Job) IsRunning() bool {
 	return atomic.LoadInt32(&j.running) != 0
 }
 
+// RunningSince returns when the job's latest run started, or false if
+// it isn't running. A job waiting to start isn't running yet.
+func (j *Job) RunningSince() (time.Time, bool) {
+	j.childMu.Lock()
+	defer j.childMu.Unlock()
+	return j.runStart, !j.runStart.IsZero()
+}
+
 type OnJobExitFunc func(string, time.Duration, *exec.Cmd, error)
 
+// OnJobRetryFunc is called after a failed attempt of a job with retries
+// left. It should wait for the backoff and return whether to try again.
+type OnJobRetryFunc func(name string, attempt int, backoff time.Duration, err error) bool
+
 func (j *Job) Start(onExit OnJobExitFunc) bool {
-	j.wg.Wait()
-	atomic.StoreInt32(&j.running, 1)
+	return j.StartWhen(func() bool { return true }, nil, onExit)
+}
+
+// CancelledError is passed to onExit when the context of a job
+// started with StartContext is done before the job finishes.
+type CancelledError struct {
+	Cause error // Why the context is done.
+	Err   error // The error from the killed command.
+}
+
+func (e *CancelledError) Error() string {
+	return fmt.Sprintf("cancelled, %s: %s", e.Cause, e.Err)
+}
+
+func (e *CancelledError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is match the cause as well as the command's error.
+func (e *CancelledError) Is(target error) bool {
+	return e.Cause == target
+}
+
+// TimeoutError is the error of a run that was killed for taking
+// longer than the job's timeout.
+type TimeoutError struct {
+	Timeout time.Duration
+	Err     error // The error from the killed command.
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s: %s", e.Timeout, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// StartWhen starts the job once ready returns, the job counts as running
+// while ready blocks. If ready returns false the command is not run
+// and onExit is not called. Failed attempts are retried as configured,
+// calling onRetry before each retry, or just waiting if it is nil.
+// Runs queued with QueueRun while the job runs go through the same steps
+// once it finishes. Unless the job runs in parallel, StartWhen waits
+// for any earlier run to finish first, so callers that don't want to
+// block should check IsRunning. Otherwise it returns straight away,
+// waiting for ready and running the command in a new goroutine.
+func (j *Job) StartWhen(ready func() bool, onRetry OnJobRetryFunc, onExit OnJobExitFunc) bool {
+	return j.StartContext(context.Background(), ready, onRetry, onExit)
+}
+
+// StartContext is StartWhen, except that the command is killed once ctx
+// is done, and no more retries or queued runs are started. onExit is
+// then passed a *CancelledError. Like Signal, the command's whole process
+// group is killed, so processes it started are killed too.
+func (j *Job) StartContext(ctx context.Context, ready func() bool, onRetry OnJobRetryFunc, onExit OnJobExitFunc) bool {
+	if j.Overlap != OverlapParallel {
+		j.wg.Wait()
+	}
+	// The job only stops counting as running once it is done
+	// with the wait group, so that then wg.Wait never blocks.
+	j.childMu.Lock()
+	atomic.AddInt32(&j.running, 1)
 	j.wg.Add(1)
+	j.childMu.Unlock()
 	go func() {
-		defer j.wg.Done()
-		defer atomic.StoreInt32(&j.running, 0)
-		j.child = exec.Command("/bin/sh", "-c", j.Command)
-		j.child.Stdout = os.Stderr
-		j.child.Stderr = os.Stderr
-		startTime := time.Now()
-		err := j.child.Run()
-		endTime := time.Now()
-		onExit(j.Name, endTime.Sub(startTime), j.child, err)
+		for {
+			if ready() {
+				start := time.Now()
+				j.childMu.Lock()
+				j.runStart = start
+				currentRunStartGauge.WithLabelValues(j.Name).Set(float64(start.UnixNano()) / 1e9)
+				j.childMu.Unlock()
+				j.attempt(ctx, onRetry, onExit)
+				j.childMu.Lock()
+				// A parallel run may have started since.
+				if j.runStart.Equal(start) {
+					j.runStart = time.Time{}
+					currentRunStartGauge.WithLabelValues(j.Name).Set(0)
+				}
+				j.childMu.Unlock()
+			}
+			j.childMu.Lock()
+			if j.queued && ctx.Err() == nil {
+				j.queued = false
+				j.childMu.Unlock()
+				continue
+			}
+			j.queued = false
+			j.wg.Done()
+			atomic.AddInt32(&j.running, -1)
+			j.childMu.Unlock()
+			return
+		}
 	}()
 	return true
 }
 
+// maxRetryBackoff is the longest a retry backoff grows to by doubling,
+// so a large @retry count can't overflow it.
+const maxRetryBackoff = 24 * time.Hour
+
+// retryBackoff is how long to wait after the given failed attempt,
+// RetryBackoff doubled for each attempt after the first.
+func (j *Job) retryBackoff(attempt int) time.Duration {
+	backoff := j.RetryBackoff
+	for i := 1; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff && j.RetryBackoff <= maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return backoff
+}
+
+// attempt runs the job until it succeeds or runs out of retries.
+func (j *Job) attempt(ctx context.Context, onRetry OnJobRetryFunc, onExit OnJobExitFunc) {
+	for attempt := 1; ; attempt++ {
+		child, duration, err := j.run(ctx)
+		if err != nil && ctx.Err() != nil {
+			onExit(j.Name, duration, child, &CancelledError{Cause: ctx.Err(), Err: err})
+			return
+		}
+		if err == nil || attempt > j.Retries {
+			onExit(j.Name, duration, child, err)
+			return
+		}
+		backoff := j.retryBackoff(attempt)
+		if onRetry == nil {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				onExit(j.Name, duration, child, &CancelledError{Cause: ctx.Err(), Err: err})
+				return
+			}
+		} else if !onRetry(j.Name, attempt, backoff, err) {
+			onExit(j.Name, duration, child, err)
+			return
+		}
+	}
+}
+
+// QueueRun arranges for the job to run again once its current run
+// finishes. It returns false if the job isn't running, in which case
+// nothing is queued. Queueing more than one run has no further effect.
+func (j *Job) QueueRun() bool {
+	j.childMu.Lock()
+	defer j.childMu.Unlock()
+	if atomic.LoadInt32(&j.running) == 0 {
+		return false
+	}
+	j.queued = true
+	return true
+}
+
+// I/O scheduling classes, as used by ioprio_set(2).
+const (
+	IOClassRealtime   = 1
+	IOClassBestEffort = 2
+	IOClassIdle       = 3
+)
+
+// setPriority applies the job's niceness and I/O priority to its
+// command, which has just been started, so only processes it starts
+// from then on inherit them. Failures are logged rather than failing
+// the job.
+func (j *Job) setPriority(pid int) {
+	if j.Nice != 0 {
+		err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, j.Nice)
+		if err != nil {
+			log.Printf("error setting niceness of job %s: %s", j.Name, err)
+		}
+	}
+	if j.IOClass != 0 {
+		err := setIOPriority(pid, j.IOClass, j.IOLevel)
+		if err != nil {
+			log.Printf("error setting I/O priority of job %s: %s", j.Name, err)
+		}
+	}
+}
+
+// command returns the command to run, through the shell unless Exec is
+// set. It runs in its own process group, so when ctx is done, such as on
+// a timeout, the processes the shell started are killed along with it.
+func (j *Job) command(ctx context.Context) *exec.Cmd {
+	var cmd *exec.Cmd
+	if j.Exec {
+		cmd = exec.CommandContext(ctx, j.Args[0], j.Args[1:]...)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", j.Command)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		if err == syscall.ESRCH {
+			return os.ErrProcessDone
+		}
+		return err
+	}
+	return cmd
+}
+
+// run runs the command once, returning the finished command and how
+// long it took. j.children must only be accessed with childMu held.
+func (j *Job) run(ctx context.Context) (*exec.Cmd, time.Duration, error) {
+	runCtx := ctx
+	if j.Timeout != 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, j.Timeout)
+		defer cancel()
+	}
+	child := j.command(runCtx)
+	child.Env = os.Environ()
+	if j.EnvFile != "" {
+		// Read each run, so rotated secrets are picked up.
+		fileEnv, err := readEnvFile(j.EnvFile)
+		if err != nil {
+			return child, 0, err
+		}
+		child.Env = append(child.Env, fileEnv...)
+	}
+	// Later values win, so the table's variables override the file's.
+	child.Env = append(child.Env, j.Env...)
+	var (
+		files    []*os.File
+		prefixed []*prefixWriter
+		// Log files the command writes to directly, with their size
+		// beforehand, so their growth can be counted.
+		direct     []*os.File
+		directSize []int64
+	)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	// open returns the writer for an @stdout or @stderr destination.
+	open := func(dest string) (io.Writer, error) {
+		var (
+			output  io.Writer
+			logFile *os.File
+		)
+		switch dest {
+		case OutputDiscard:
+			return nil, nil
+		case OutputStdout:
+			output = os.Stdout
+		case OutputStderr:
+			output = os.Stderr
+		case "":
+			if j.LogFile == "" {
+				output = os.Stderr
+				break
+			}
+			dest = j.LogFile
+			fallthrough
+		default:
+			f, err := openLogFile(dest)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, f)
+			output = f
+			logFile = f
+		}
+		if j.LogTimestamps || j.PrefixOutput {
+			p := &prefixWriter{w: output, prefix: j.outputPrefix}
+			prefixed = append(prefixed, p)
+			output = p
+		} else if j.OutputLimit == 0 && logFile != nil {
+			// Given a log file, the command writes to it directly rather
+			// than through a pipe, so background processes it starts
+			// don't hold up the run finishing. Its growth is counted
+			// instead. promcron's own stdout and stderr may be shared, so
+			// output to them is counted as it passes through a pipe.
+			st, err := logFile.Stat()
+			if err == nil {
+				direct = append(direct, logFile)
+				directSize = append(directSize, st.Size())
+				return output, nil
+			}
+		}
+		return &limitWriter{w: output, limit: j.OutputLimit, count: func(n int) {
+			outputBytesCounter.WithLabelValues(j.Name).Add(float64(n))
+		}}, nil
+	}
+	stdout, err := open(j.Stdout)
+	if err != nil {
+		return child, 0, err
+	}
+	// Sharing a writer keeps stdout and stderr in order.
+	stderr := stdout
+	if j.Stderr != j.Stdout {
+		stderr, err = open(j.Stderr)
+		if err != nil {
+			return child, 0, err
+		}
+	}
+	child.Stdout = stdout
+	child.Stderr = stderr
+	// Background processes holding a pipe open can't keep the run going.
+	child.WaitDelay = outputWaitDelay
+	startTime := time.Now()
+	j.childMu.Lock()
+	err = child.Start()
+	if err == nil {
+		j.setPriority(child.Process.Pid)
+		if j.children == nil {
+			j.children = make(map[*exec.Cmd]struct{})
+		}
+		j.children[child] = struct{}{}
+	}
+	j.childMu.Unlock()
+	if err == nil {
+		err = child.Wait()
+		j.childMu.Lock()
+		delete(j.children, child)
+		j.childMu.Unlock()
+	}
+	endTime := time.Now()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		log.Printf("job %s left processes holding its output open, their further output is lost", j.Name)
+		err = nil
+	}
+	for _, p := range prefixed {
+		p.Flush()
+	}
+	for i, f := range direct {
+		st, statErr := f.Stat()
+		if statErr == nil && st.Size() > directSize[i] {
+			outputBytesCounter.WithLabelValues(j.Name).Add(float64(st.Size() - directSize[i]))
+		}
+	}
+	if err != nil && runCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		err = &TimeoutError{Timeout: j.Timeout, Err: err}
+	}
+	return child, endTime.Sub(startTime), err
+}
+
+func (j *Job) outputPrefix() string {
+	prefix := ""
+	if j.LogTimestamps {
+		prefix = timestampPrefix()
+	}
+	if j.PrefixOutput {
+		prefix += "[" + j.Name + "] "
+	}
+	return prefix
+}
+
+// Signal sends sig to the process groups of the job's running commands,
+// so it reaches the processes they started too, returning the first error.
+func (j *Job) Signal(sig os.Signal) error {
+	j.childMu.Lock()
+	defer j.childMu.Unlock()
+	var firstErr error
+	for child := range j.children {
+		var err error
+		if s, ok := sig.(syscall.Signal); ok {
+			err = syscall.Kill(-child.Process.Pid, s)
+			if err == syscall.ESRCH {
+				// Reaped, but not yet removed from children.
+				err = os.ErrProcessDone
+			}
+		} else {
+			err = child.Process.Signal(sig)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// started reports whether a process of the job has been started
+// and is still running.
+func (j *Job) started() bool {
+	j.childMu.Lock()
+	defer j.childMu.Unlock()
+	return len(j.children) > 0
+}
+
 func (j *Job) Wait() {
 	j.wg.Wait()
 }
@@ -1,8 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestParse(t *testing.T) {
@@ -93,6 +106,52 @@ func TestParse(t *testing.T) {
 				"Feb 1 15:01",
 			},
 		},
+		testcase{
+			tab: "5 0 0 L * * true",
+			runTimes: []string{
+				"Jan 31 00:00",
+				"Apr 30 00:00",
+				// Parsed times are in year 0, which is a leap year.
+				"Feb 29 00:00",
+			},
+			skipTimes: []string{
+				"Jan 30 00:00",
+				"Feb 28 00:00",
+				"Apr 1 00:00",
+			},
+		},
+		testcase{
+			tab: "6 0 0 1,L-1 * * true",
+			runTimes: []string{
+				"Jan 1 00:00",
+				"Jan 30 00:00",
+				"Apr 29 00:00",
+			},
+			skipTimes: []string{
+				"Jan 31 00:00",
+				"Apr 30 00:00",
+			},
+		},
+		testcase{
+			tab: "7 0 0 * * tue#2 true",
+			runTimes: []string{
+				"Jan 11 00:00",
+			},
+			skipTimes: []string{
+				"Jan 4 00:00",
+				"Jan 10 00:00",
+				"Jan 18 00:00",
+			},
+		},
+		testcase{
+			tab: "8 0 0 * * 1#5 true",
+			runTimes: []string{
+				"Jan 31 00:00",
+			},
+			skipTimes: []string{
+				"Jan 24 00:00",
+			},
+		},
 	}
 
 	for _, tc := range matchingCases {
@@ -123,3 +182,1346 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+func TestParseSeconds(t *testing.T) {
+	jobs, err := ParseJobs("test", "@seconds\n1 */15 * * * * * true\n2 0 * * * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("expected 2 jobs, got %d", len(jobs))
+	}
+
+	tfmt := "Jan _2 15:04:05"
+	for _, ts := range []string{"Jan 1 15:00:00", "Jan 1 15:00:15", "Jan 1 15:04:45"} {
+		parsedTime, err := time.Parse(tfmt, ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !jobs[0].ShouldRunAt(&parsedTime) {
+			t.Fatalf("job %s should run at %s", jobs[0].Name, parsedTime)
+		}
+	}
+	for _, ts := range []string{"Jan 1 15:00:01", "Jan 1 15:00:14", "Jan 1 15:04:59"} {
+		parsedTime, err := time.Parse(tfmt, ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if jobs[0].ShouldRunAt(&parsedTime) {
+			t.Fatalf("job %s should not run at %s", jobs[0].Name, parsedTime)
+		}
+	}
+
+	jobs, err = ParseJobs("test", "1 */15 * * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs[0].Second != 0 {
+		t.Fatal("jobs should not have a seconds field without @seconds")
+	}
+}
+
+func TestParseDirectives(t *testing.T) {
+	jobs, err := ParseJobs("test", "@jitter 30s\n@retry 3 10s\n@overlap queue\n1 * * * * * true\n2 * * * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs[0].Retries != 3 || jobs[0].RetryBackoff != 10*time.Second {
+		t.Fatalf("job %s has %d retries with backoff %s", jobs[0].Name, jobs[0].Retries, jobs[0].RetryBackoff)
+	}
+	if jobs[0].MaxJitter != 30*time.Second {
+		t.Fatalf("job %s has jitter %s", jobs[0].Name, jobs[0].MaxJitter)
+	}
+	if jobs[1].MaxJitter != 0 {
+		t.Fatalf("job %s has jitter %s", jobs[1].Name, jobs[1].MaxJitter)
+	}
+	if jobs[0].Overlap != OverlapQueue || jobs[1].Overlap != "" {
+		t.Fatalf("jobs have overlap policies %q and %q", jobs[0].Overlap, jobs[1].Overlap)
+	}
+
+	jobs, err = ParseJobs("test", "@max-duration 90s\n1 * * * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs[0].MaxDuration != 90*time.Second {
+		t.Fatalf("job %s has max duration %s", jobs[0].Name, jobs[0].MaxDuration)
+	}
+
+	jobs, err = ParseJobs("test", "@overdue-after 5m\n1 * * * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs[0].OverdueAfter != 5*time.Minute {
+		t.Fatalf("job %s is overdue after %s", jobs[0].Name, jobs[0].OverdueAfter)
+	}
+
+	jobs, err = ParseJobs("test", "@disabled\n1 * * * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if !jobs[0].Disabled || jobs[0].ShouldRunAt(&now) {
+		t.Fatalf("expected job %s to be disabled", jobs[0].Name)
+	}
+	if _, ok := jobs[0].NextRun(now, now.Add(time.Hour)); ok {
+		t.Fatalf("expected disabled job %s to have no next run", jobs[0].Name)
+	}
+
+	jobs, err = ParseJobs("test", "@nice 10\n@ionice best-effort:6\n1 * * * * * true\n@ionice realtime\n2 * * * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs[0].Nice != 10 || jobs[0].IOClass != IOClassBestEffort || jobs[0].IOLevel != 6 {
+		t.Fatalf("job %s has niceness %d and I/O priority %d:%d", jobs[0].Name, jobs[0].Nice, jobs[0].IOClass, jobs[0].IOLevel)
+	}
+	if jobs[1].Nice != 0 || jobs[1].IOClass != IOClassRealtime || jobs[1].IOLevel != 4 {
+		t.Fatalf("job %s has niceness %d and I/O priority %d:%d", jobs[1].Name, jobs[1].Nice, jobs[1].IOClass, jobs[1].IOLevel)
+	}
+
+	for _, tab := range []string{
+		"@jitter 30s",
+		"@jitter bad\n1 * * * * * true",
+		"@nonsense\n1 * * * * * true",
+		"@retry 3\n1 * * * * * true",
+		"@overlap sometimes\n1 * * * * * true",
+		"@heartbeat ftp://example.com/ping\n1 * * * * * true",
+		"@on-failure\n1 * * * * * true",
+		"@nice 20\n1 * * * * * true",
+		"@ionice idle:3\n1 * * * * * true",
+		"@ionice best-effort:8\n1 * * * * * true",
+		"@output-limit 10X\n1 * * * * * true",
+		"@max-duration 0s\n1 * * * * * true",
+		"@skip-if-exists\n1 * * * * * true",
+		"@overdue-after -1m\n1 * * * * * true",
+	} {
+		_, err := ParseJobs("test", tab)
+		if err == nil {
+			t.Fatalf("expected an error parsing %q", tab)
+		}
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	tab := "1 * * * * * true\nFOO=bar\nPATH = \"/bin:/usr/bin\"\n2 * * * * * FOO=baz true\nFOO=''\n3 * * * * * true"
+	jobs, err := ParseJobs("test", tab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{},
+		{"FOO=bar", "PATH=/bin:/usr/bin"},
+		{"FOO=bar", "PATH=/bin:/usr/bin", "FOO="},
+	}
+	for i, j := range jobs {
+		if strings.Join(j.Env, "\n") != strings.Join(expected[i], "\n") {
+			t.Fatalf("job %s has env %q, expected %q", j.Name, j.Env, expected[i])
+		}
+	}
+	if jobs[1].Command != "FOO=baz true" {
+		t.Fatalf("unexpected command %q", jobs[1].Command)
+	}
+
+	for _, tab := range []string{
+		"=bar",
+		"1FOO=bar",
+		"FOO-BAR=baz",
+		"FOO=\"bar",
+	} {
+		_, err := ParseJobs("test", tab)
+		if err == nil {
+			t.Fatalf("expected an error parsing %q", tab)
+		}
+	}
+}
+
+func TestParseExec(t *testing.T) {
+	jobs, err := ParseJobs("test", `@exec
+1 * * * * * printf '%s\n' "a b" c\ d "\"\$\x" $HOME|cat # comment
+2 * * * * * printf x`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"printf", "%s\\n", "a b", "c d", `"$\x`, "$HOME|cat"}
+	if !jobs[0].Exec || strings.Join(jobs[0].Args, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("job %s has args %q, expected %q", jobs[0].Name, jobs[0].Args, expected)
+	}
+	if jobs[1].Exec || jobs[1].Args != nil {
+		t.Fatalf("job %s unexpectedly has exec set", jobs[1].Name)
+	}
+
+	for _, tab := range []string{
+		"@exec\n1 * * * * * echo 'a",
+		"@exec\n1 * * * * * echo \"a",
+		"@exec x\n1 * * * * * echo",
+	} {
+		_, err := ParseJobs("test", tab)
+		if err == nil {
+			t.Fatalf("expected an error parsing %q", tab)
+		}
+	}
+
+	_, err = ParseJobs("test", "@exec\ncopy * * * * * cp \"my file\" 'other file")
+	msg := "parse error test:2:29 unterminated ' quote in command\n\tcopy * * * * * cp \"my file\" 'other file\n\t                            ^"
+	if err == nil || err.Error() != msg {
+		t.Fatalf("expected error %q, got %v", msg, err)
+	}
+
+	// Commands that expand to nothing would leave nothing to run.
+	for _, tc := range []struct {
+		tab      string
+		expected string
+	}{
+		{"@exec\na * * * * * $PROMCRON_TEST_UNDEFINED", "command is empty once variables are expanded"},
+		{"@exec\na * * * * * ${PROMCRON_TEST_UNDEFINED}  ", "command is empty once variables are expanded"},
+		{"a * * * * * $PROMCRON_TEST_UNDEFINED", "command is empty once variables are expanded"},
+		{"@exec\nEMPTY=\"\"\na * * * * * $EMPTY", "command is empty once variables are expanded"},
+	} {
+		_, err := ParseJobsWithOptions("test", tc.tab, ParseOptions{ExpandEnv: true})
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("expected an error containing %q parsing %q, got %v", tc.expected, tc.tab, err)
+		}
+	}
+}
+
+func TestSplay(t *testing.T) {
+	tab := "@splay\na 0 * * * * true\nb 0 * * * * true"
+	jobs, err := ParseJobsWithOptions("test", tab, ParseOptions{SplaySeed: "host1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := SplayOffset("host1", "a")
+	if jobs[0].Splay != offset || jobs[1].Splay != 0 {
+		t.Fatalf("jobs have splay %s and %s, expected %s and 0s", jobs[0].Splay, jobs[1].Splay, offset)
+	}
+	if offset%time.Minute != 0 || offset < 0 || offset >= time.Hour {
+		t.Fatalf("unexpected splay %s", offset)
+	}
+	if SplayOffset("host1", "a") != offset {
+		t.Fatalf("splay is not deterministic")
+	}
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 20; i++ {
+		seen[SplayOffset(fmt.Sprintf("host%d", i), "a")] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("expected hosts to get different splays")
+	}
+
+	hour := time.Date(2021, time.June, 1, 10, 0, 0, 0, time.UTC)
+	shifted := hour.Add(offset)
+	if !jobs[0].ShouldRunAt(&shifted) {
+		t.Fatalf("expected job to run at %s", shifted)
+	}
+	if offset != 0 && jobs[0].ShouldRunAt(&hour) {
+		t.Fatalf("expected job not to run at %s", hour)
+	}
+	next, ok := jobs[0].NextRun(hour.Add(-time.Second), hour.Add(time.Hour))
+	if !ok || !next.Equal(shifted) {
+		t.Fatalf("expected next run at %s, got %s", shifted, next)
+	}
+
+	jobs, err = ParseJobsWithOptions("test", tab, ParseOptions{Splay: true, SplaySeed: "host1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs[1].Splay != SplayOffset("host1", "b") {
+		t.Fatalf("expected Splay to splay every job")
+	}
+}
+
+func TestParseRequires(t *testing.T) {
+	jobs, err := ParseJobs("test", "extract 0 1 * * * true\n@requires extract\nload 0 2 * * * true\n@requires load\n\"report all\" 0 3 * * * true\n@requires report all\nemail 0 4 * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, requires := range []string{"", "extract", "load", "report all"} {
+		if jobs[i].Requires != requires {
+			t.Fatalf("job %s requires %q, expected %q", jobs[i].Name, jobs[i].Requires, requires)
+		}
+	}
+
+	for _, tc := range []struct {
+		tab      string
+		expected string
+	}{
+		{"@requires missing\na * * * * * true", "parse error test:2 job a requires unknown job missing"},
+		{"@requires a\na * * * * * true", "parse error test:2 job a requires itself: a -> a"},
+		{"@requires c\na * * * * * true\n@requires a\nb * * * * * true\n@requires b\nc * * * * * true", "parse error test:2 job a requires itself: a -> c -> b -> a"},
+		{"@requires\na * * * * * true", "parse error test:1 invalid @requires directive"},
+	} {
+		_, err := ParseJobs("test", tc.tab)
+		if err == nil || !strings.HasPrefix(err.Error(), tc.expected) {
+			t.Fatalf("expected an error starting %q parsing %q, got %v", tc.expected, tc.tab, err)
+		}
+	}
+}
+
+func TestParseExpandEnv(t *testing.T) {
+	os.Setenv("PROMCRON_TEST_HOME", "/home/test")
+	defer os.Unsetenv("PROMCRON_TEST_HOME")
+	tab := "DATA_DIR=/data\na * * * * * cp $PROMCRON_TEST_HOME/x ${DATA_DIR} $1 $$ $UNDEFINED_FOR_TEST"
+	jobs, err := ParseJobsWithOptions("test", tab, ParseOptions{ExpandEnv: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs[0].Command != "cp /home/test/x /data $1 $$ " {
+		t.Fatalf("unexpected command %q", jobs[0].Command)
+	}
+
+	_, err = ParseJobsWithOptions("test", tab, ParseOptions{ExpandEnv: true, StrictEnv: true})
+	if err == nil || !strings.Contains(err.Error(), "undefined variable UNDEFINED_FOR_TEST") {
+		t.Fatalf("expected an undefined variable error, got %v", err)
+	}
+
+	jobs, err = ParseJobs("test", tab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(jobs[0].Command, "${DATA_DIR}") {
+		t.Fatalf("command expanded without ExpandEnv: %q", jobs[0].Command)
+	}
+}
+
+func TestParseDuplicateNames(t *testing.T) {
+	for _, tab := range []string{
+		"a * * * * * true\na * * * * * true",
+		"a 0 * * * * true\nb * * * * * true\na 1 * * * * false",
+	} {
+		_, err := ParseJobs("test", tab)
+		if err == nil {
+			t.Fatalf("expected a duplicate name error parsing %q", tab)
+		}
+		if !strings.Contains(err.Error(), "duplicate job name a") {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+
+	_, err := ParseJobs("test", "a * * * * * true\nb * * * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseQuotedNames(t *testing.T) {
+	jobs, err := ParseJobs("test", `"nightly backup" 0 2 * * * echo "done"`+"\n"+`"say \"hi\" \\" * * * * * true`+"\nplain * * * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct{ name, command string }{
+		{"nightly backup", `echo "done"`},
+		{`say "hi" \`, "true"},
+		{"plain", "true"},
+	}
+	for i, j := range jobs {
+		if j.Name != expected[i].name || j.Command != expected[i].command {
+			t.Fatalf("expected job %q with command %q, got %q with %q", expected[i].name, expected[i].command, j.Name, j.Command)
+		}
+	}
+
+	for _, tab := range []string{
+		`"nightly backup 0 2 * * * true`,
+		`"nightly backup\" 0 2 * * * true`,
+		`"" 0 2 * * * true`,
+	} {
+		_, err := ParseJobs("test", tab)
+		if err == nil {
+			t.Fatalf("expected an error parsing %q", tab)
+		}
+	}
+}
+
+func TestParseContinuations(t *testing.T) {
+	tab := "a 0 \\\n2 * * * echo one \\\n  two\nb * * * * * echo 'trailing \\\\'\n# comment \\\nc * * * * * true"
+	jobs, err := ParseJobs("test", tab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 3 {
+		t.Fatalf("expected 3 jobs, got %d", len(jobs))
+	}
+	if jobs[0].Hour != 1<<2 || jobs[0].Command != "echo one   two" {
+		t.Fatalf("unexpected job %s hour %b command %q", jobs[0].Name, jobs[0].Hour, jobs[0].Command)
+	}
+	if jobs[1].Command != "echo 'trailing \\\\'" {
+		t.Fatalf("unexpected command %q", jobs[1].Command)
+	}
+
+	_, err = ParseJobs("test", "a * * * * * true\nb 0 \\\n99 * * * true")
+	if err == nil || !strings.Contains(err.Error(), "test:2:") {
+		t.Fatalf("expected an error on the first line of the continuation, got %v", err)
+	}
+}
+
+func TestParseInclude(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"main":       "FOO=bar\na * * * * * true\n@include sub\n@includedir sub.d\nd * * * * * true",
+		"sub":        "b * * * * * true",
+		"sub.d/2":    "FOO=baz\nc2 * * * * * true",
+		"sub.d/1":    "c1 * * * * * true",
+		"sub.d/.tmp": "not a table",
+		"cycle":      "@include cycle2",
+		"cycle2":     "@include cycle",
+	}
+	for name, data := range files {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fname := filepath.Join(dir, "main")
+	jobs, err := ParseJobs(fname, files["main"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, j := range jobs {
+		names = append(names, j.Name)
+	}
+	if strings.Join(names, ",") != "a,b,c1,c2,d" {
+		t.Fatalf("unexpected jobs %v", names)
+	}
+	if strings.Join(jobs[3].Env, ",") != "FOO=bar,FOO=baz" || strings.Join(jobs[4].Env, ",") != "FOO=bar" {
+		t.Fatalf("unexpected environments %v and %v", jobs[3].Env, jobs[4].Env)
+	}
+
+	_, err = ParseJobs(filepath.Join(dir, "cycle"), files["cycle"])
+	if err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Fatalf("expected an include cycle error, got %v", err)
+	}
+
+	_, err = ParseJobs(fname, "b * * * * * true\n@include sub")
+	if err == nil || !strings.Contains(err.Error(), "duplicate job name b") {
+		t.Fatalf("expected a duplicate name error, got %v", err)
+	}
+}
+
+func TestJobSignalWhileStarting(t *testing.T) {
+	// Run with -race, signalling must not race with the job starting.
+	j := &Job{Name: "test", Command: "exit 0"}
+	for i := 0; i < 20; i++ {
+		exited := make(chan struct{})
+		j.Start(func(name string, duration time.Duration, child *exec.Cmd, err error) {
+			close(exited)
+		})
+		for j.IsRunning() {
+			err := j.Signal(syscall.Signal(0))
+			if err != nil && err != os.ErrProcessDone {
+				t.Fatal(err)
+			}
+		}
+		j.Wait()
+		<-exited
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		backoff  time.Duration
+		attempt  int
+		expected time.Duration
+	}{
+		{time.Second, 1, time.Second},
+		{time.Second, 4, 8 * time.Second},
+		{time.Hour, 5, 16 * time.Hour},
+		{time.Hour, 6, maxRetryBackoff},
+		// Shifting by this much would overflow to zero or less.
+		{time.Second, 64, maxRetryBackoff},
+		{time.Minute, 1000, maxRetryBackoff},
+		// A backoff already over the maximum is kept, but not doubled.
+		{48 * time.Hour, 3, 48 * time.Hour},
+		{0, 100, 0},
+	} {
+		j := &Job{RetryBackoff: tc.backoff}
+		if backoff := j.retryBackoff(tc.attempt); backoff != tc.expected {
+			t.Fatalf("backoff %s after attempt %d: expected %s, got %s", tc.backoff, tc.attempt, tc.expected, backoff)
+		}
+	}
+}
+
+func TestStartContextCancel(t *testing.T) {
+	j := &Job{Name: "test", Command: "exec sleep 10", Retries: 3, RetryBackoff: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	exited := make(chan error, 1)
+	j.StartContext(ctx, func() bool { return true }, nil, func(name string, duration time.Duration, child *exec.Cmd, err error) {
+		exited <- err
+	})
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-exited:
+		var cancelled *CancelledError
+		if !errors.As(err, &cancelled) || !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected the job to be cancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job was not killed when its context was cancelled")
+	}
+	j.Wait()
+}
+
+func TestTimeout(t *testing.T) {
+	jobs, err := ParseJobsWithOptions("test", "a * * * * * true\n@timeout 5m\nb * * * * * true\n@timeout 0s\nc * * * * * true", ParseOptions{Timeout: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []time.Duration{time.Hour, 5 * time.Minute, 0} {
+		if jobs[i].Timeout != expected {
+			t.Fatalf("expected job %s to time out after %s, got %s", jobs[i].Name, expected, jobs[i].Timeout)
+		}
+	}
+
+	j := &Job{Name: "test", Command: "exec sleep 10", Timeout: 100 * time.Millisecond}
+	exited := make(chan error, 1)
+	j.Start(func(name string, duration time.Duration, child *exec.Cmd, err error) {
+		exited <- err
+	})
+	select {
+	case err := <-exited:
+		var timeout *TimeoutError
+		if !errors.As(err, &timeout) || timeout.Timeout != j.Timeout {
+			t.Fatalf("expected the job to time out, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job was not killed after its timeout")
+	}
+	j.Wait()
+
+	// Without exec the shell runs sleep as a child, which holds the
+	// output pipe open and must be killed too.
+	j = &Job{Name: "test", Command: "sleep 10; true", Timeout: 200 * time.Millisecond, OutputLimit: 1000}
+	start := time.Now()
+	_, _, err = j.run(context.Background())
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) {
+		t.Fatalf("expected the job to time out, got %v", err)
+	}
+	if took := time.Since(start); took > 700*time.Millisecond {
+		t.Fatalf("expected the run to end soon after its timeout, took %s", took)
+	}
+}
+
+func TestEnvFile(t *testing.T) {
+	dir := t.TempDir()
+	envFile := filepath.Join(dir, "env")
+	out := filepath.Join(dir, "out")
+	jobs, err := ParseJobs("test", "FOO=table\n@env-file "+envFile+"\na * * * * * echo \"$FOO $BAR\" > "+out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := jobs[0]
+	if j.EnvFile != envFile {
+		t.Fatalf("expected env file %s, got %q", envFile, j.EnvFile)
+	}
+	run := func() error {
+		exited := make(chan error, 1)
+		j.Start(func(name string, duration time.Duration, child *exec.Cmd, err error) {
+			exited <- err
+		})
+		j.Wait()
+		return <-exited
+	}
+
+	if err := run(); err == nil || !strings.Contains(err.Error(), "error reading env file") {
+		t.Fatalf("expected a missing env file to fail the run, got %v", err)
+	}
+	for _, tc := range []struct {
+		contents string
+		expected string
+	}{
+		{"# secrets\nFOO=file\n\nBAR=\"first secret\"\n", "table first secret\n"},
+		// Rotated secrets are read on the next run.
+		{"BAR=second\n", "table second\n"},
+	} {
+		err := ioutil.WriteFile(envFile, []byte(tc.contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := run(); err != nil {
+			t.Fatal(err)
+		}
+		output, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(output) != tc.expected {
+			t.Fatalf("expected output %q, got %q", tc.expected, output)
+		}
+	}
+
+	err = ioutil.WriteFile(envFile, []byte("BAR=ok\nnot an assignment\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run(); err == nil || !strings.Contains(err.Error(), envFile+":2: expected KEY=VALUE") {
+		t.Fatalf("expected a bad env file to fail the run, got %v", err)
+	}
+}
+
+func TestRunningSince(t *testing.T) {
+	j := &Job{Name: "test", Command: "sleep 0.2"}
+	if _, ok := j.RunningSince(); ok {
+		t.Fatal("expected a new job not to be running")
+	}
+	release := make(chan struct{})
+	before := time.Now()
+	j.StartWhen(func() bool {
+		<-release
+		return true
+	}, nil, func(string, time.Duration, *exec.Cmd, error) {})
+	if _, ok := j.RunningSince(); ok {
+		t.Fatal("expected a job waiting to start not to be running")
+	}
+	close(release)
+	time.Sleep(100 * time.Millisecond)
+	start, ok := j.RunningSince()
+	if !ok || start.Before(before) || start.After(time.Now()) {
+		t.Fatalf("expected the job to be running since about %s, got %s", before, start)
+	}
+	if v := testutil.ToFloat64(currentRunStartGauge.WithLabelValues(j.Name)); v != float64(start.UnixNano())/1e9 {
+		t.Fatalf("expected the current run to have started at %v, got %v", float64(start.UnixNano())/1e9, v)
+	}
+	j.Wait()
+	if _, ok := j.RunningSince(); ok {
+		t.Fatal("expected a finished job not to be running")
+	}
+	if v := testutil.ToFloat64(currentRunStartGauge.WithLabelValues(j.Name)); v != 0 {
+		t.Fatalf("expected no current run, got one started at %v", v)
+	}
+}
+
+func TestNextRun(t *testing.T) {
+	jobs, err := ParseJobs("test", "daily 30 2 * * * true\nnever 0 0 30 feb * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2021, 6, 1, 2, 30, 0, 0, time.UTC)
+	next, ok := jobs[0].NextRun(from, from.Add(48*time.Hour))
+	if !ok || !next.Equal(from.Add(24*time.Hour)) {
+		t.Fatalf("expected next run at %s, got %s", from.Add(24*time.Hour), next)
+	}
+	if _, ok := jobs[1].NextRun(from, from.Add(366*24*time.Hour)); ok {
+		t.Fatal("expected no next run")
+	}
+
+	jobs, err = ParseJobsWithOptions("test", "fast */15 * * * * * true", ParseOptions{Seconds: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, ok = jobs[0].NextRun(from.Add(50*time.Second), from.Add(time.Hour))
+	if !ok || !next.Equal(from.Add(time.Minute)) {
+		t.Fatalf("expected next run at %s, got %s", from.Add(time.Minute), next)
+	}
+}
+
+func TestParseRangeSteps(t *testing.T) {
+	bitsOf := func(values ...uint) uint64 {
+		var bits uint64
+		for _, v := range values {
+			bits |= 1 << v
+		}
+		return bits
+	}
+	for _, tc := range []struct {
+		field string
+		r     bounds
+		bits  uint64
+	}{
+		{"10-20/3", minuteBound, bitsOf(10, 13, 16, 19)},
+		{"1-30/2", minuteBound, bitsOf(1, 3, 5, 7, 9, 11, 13, 15, 17, 19, 21, 23, 25, 27, 29)},
+		{"10-20/1", minuteBound, bitsOf(10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20)},
+		{"50/4", minuteBound, bitsOf(50, 54, 58)},
+		{"5-5/10", minuteBound, bitsOf(5)},
+		{"0-23/12", hourBound, bitsOf(0, 12)},
+		{"1-10/3,20-22/2", minuteBound, bitsOf(1, 4, 7, 10, 20, 22)},
+	} {
+		bits, err := parseTimeField(tc.field, tc.r)
+		if err != nil {
+			t.Fatalf("%q: %s", tc.field, err)
+		}
+		if bits != tc.bits {
+			t.Fatalf("%q: expected bits %b, got %b", tc.field, tc.bits, bits)
+		}
+	}
+
+	for _, field := range []string{"20-10/2", "10-20/0", "10-60/2", "10-20/x", "1-2/3/4"} {
+		_, err := parseTimeField(field, minuteBound)
+		if err == nil {
+			t.Fatalf("expected an error parsing %q", field)
+		}
+	}
+}
+
+func TestParseNames(t *testing.T) {
+	bitsOf := func(values ...uint) uint64 {
+		var bits uint64
+		for _, v := range values {
+			bits |= 1 << v
+		}
+		return bits
+	}
+	for _, tc := range []struct {
+		field string
+		r     bounds
+		bits  uint64
+	}{
+		{"mon-fri", dowBound, bitsOf(1, 2, 3, 4, 5)},
+		{"mon,wed,fri", dowBound, bitsOf(1, 3, 5)},
+		{"1-fri", dowBound, bitsOf(1, 2, 3, 4, 5)},
+		{"sun,3-thu", dowBound, bitsOf(0, 3, 4)},
+		{"MON-Wed", dowBound, bitsOf(1, 2, 3)},
+		{"sun-sat/2", dowBound, bitsOf(0, 2, 4, 6)},
+		{"jan-mar", monthBound, bitsOf(1, 2, 3)},
+		{"jan,jun,12", monthBound, bitsOf(1, 6, 12)},
+		{"6-dec/3", monthBound, bitsOf(6, 9, 12)},
+		{"feb/4", monthBound, bitsOf(2, 6, 10)},
+	} {
+		bits, err := parseTimeField(tc.field, tc.r)
+		if err != nil {
+			t.Fatalf("%q: %s", tc.field, err)
+		}
+		if bits != tc.bits {
+			t.Fatalf("%q: expected bits %b, got %b", tc.field, tc.bits, bits)
+		}
+	}
+
+	for _, field := range []string{"fri-mon", "mon-funday", "mon-tue-wed", "jan-mar"} {
+		_, err := parseTimeField(field, dowBound)
+		if err == nil {
+			t.Fatalf("expected an error parsing %q", field)
+		}
+	}
+
+	jobs, err := ParseJobs("test", "a 0 9 * jan-mar mon-fri true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs[0].Month != bitsOf(1, 2, 3) || jobs[0].Dow != bitsOf(1, 2, 3, 4, 5) {
+		t.Fatalf("expected named ranges to parse, got month %b and day of week %b", jobs[0].Month, jobs[0].Dow)
+	}
+}
+
+func TestParseSunday7(t *testing.T) {
+	for _, tc := range []struct {
+		field string
+		dow   uint64
+		nth   [7]uint8
+	}{
+		{"7", 1 << 0, [7]uint8{}},
+		{"0,7", 1 << 0, [7]uint8{}},
+		{"7-7", 1 << 0, [7]uint8{}},
+		{"5-7", 1<<5 | 1<<6 | 1<<0, [7]uint8{}},
+		{"sat-7", 1<<6 | 1<<0, [7]uint8{}},
+		{"sun-7", 0x7f, [7]uint8{}},
+		// Steps from a single start still end on Saturday.
+		{"1/2", 1<<1 | 1<<3 | 1<<5, [7]uint8{}},
+		{"1/3", 1<<1 | 1<<4, [7]uint8{}},
+		{"5/1", 1<<5 | 1<<6, [7]uint8{}},
+		{"*/2", 1<<0 | 1<<2 | 1<<4 | 1<<6 | starBit, [7]uint8{}},
+		{"*/3", 1<<0 | 1<<3 | 1<<6 | starBit, [7]uint8{}},
+		{"1-7/2", 1<<1 | 1<<3 | 1<<5 | 1<<0, [7]uint8{}},
+		{"7/2", 1 << 0, [7]uint8{}},
+		{"7#2", 0, [7]uint8{0: 1 << 2}},
+	} {
+		dow, nth, err := parseDowField(tc.field)
+		if err != nil {
+			t.Fatalf("%q: %s", tc.field, err)
+		}
+		if dow != tc.dow || nth != tc.nth {
+			t.Fatalf("%q: expected %b and %v, got %b and %v", tc.field, tc.dow, tc.nth, dow, nth)
+		}
+	}
+
+	jobs, err := ParseJobs("test", "a 0 0 * * 7 true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sunday := time.Date(2021, time.June, 6, 0, 0, 0, 0, time.UTC)
+	if !jobs[0].ShouldRunAt(&sunday) {
+		t.Fatal("expected 7 to run on Sunday")
+	}
+}
+
+func TestParseRandom(t *testing.T) {
+	jobs, err := ParseJobsWithOptions("test", "a R 2 * * * true\nb 0~29 ~ * * * true\nc 10~ * * * * true", ParseOptions{SplaySeed: "host1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := jobs[0], jobs[1], jobs[2]
+	if a.Random != RandomMinute || a.Minute != getBits(0, 59, 1) || a.RandomSeed != "host1" {
+		t.Fatalf("unexpected random minute %b of %x seeded %q", a.Random, a.Minute, a.RandomSeed)
+	}
+	if b.Random != RandomMinute|RandomHour || b.Minute != getBits(0, 29, 1) {
+		t.Fatalf("unexpected random fields %b, minute %x", b.Random, b.Minute)
+	}
+	if c.Minute != getBits(10, 59, 1) {
+		t.Fatalf("unexpected minute %x", c.Minute)
+	}
+
+	// Each day a runs exactly once, in hour 2, and b exactly once in the
+	// first half of an hour.
+	start := time.Date(2021, time.June, 1, 0, 0, 0, 0, time.UTC)
+	minutes := map[int]bool{}
+	for day := 0; day < 30; day++ {
+		var aRuns, bRuns []time.Time
+		for m := 0; m < 24*60; m++ {
+			at := start.AddDate(0, 0, day).Add(time.Duration(m) * time.Minute)
+			if a.ShouldRunAt(&at) {
+				aRuns = append(aRuns, at)
+			}
+			if b.ShouldRunAt(&at) {
+				bRuns = append(bRuns, at)
+			}
+		}
+		if len(aRuns) != 1 || aRuns[0].Hour() != 2 {
+			t.Fatalf("expected a to run once in hour 2 on day %d, got %v", day, aRuns)
+		}
+		if len(bRuns) != 1 || bRuns[0].Minute() >= 30 {
+			t.Fatalf("expected b to run once in the first half hour on day %d, got %v", day, bRuns)
+		}
+		minutes[aRuns[0].Minute()] = true
+
+		next, ok := a.NextRun(start.AddDate(0, 0, day), start.AddDate(0, 0, day+1))
+		if !ok || !next.Equal(aRuns[0]) {
+			t.Fatalf("expected the next run on day %d to be %s, got %s", day, aRuns[0], next)
+		}
+	}
+	if len(minutes) < 10 {
+		t.Fatalf("expected the minute to change from day to day, got %v", minutes)
+	}
+
+	// Another host picks differently, but the same one picks the same.
+	other, err := ParseJobsWithOptions("test", "a R 2 * * * true", ParseOptions{SplaySeed: "host2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, err := ParseJobsWithOptions("test", "a R 2 * * * true", ParseOptions{SplaySeed: "host1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := start.AddDate(0, 0, 30)
+	differs := false
+	for at := start; at.Before(end); at = at.Add(time.Minute) {
+		if a.ShouldRunAt(&at) != same[0].ShouldRunAt(&at) {
+			t.Fatalf("expected the same seed to pick the same time at %s", at)
+		}
+		differs = differs || a.ShouldRunAt(&at) != other[0].ShouldRunAt(&at)
+	}
+	if !differs {
+		t.Fatal("expected another seed to pick different times")
+	}
+
+	for _, tc := range []struct {
+		line     string
+		expected string
+	}{
+		{"a 0-10~20 * * * * true", "~ cannot be combined with a list, range or step"},
+		{"a 1,R * * * * true", "invalid minute spec: failed to parse int from R"},
+		{"a 0~10~20 * * * * true", "too many tildes"},
+		{"a 0~60 * * * * true", "end of range (60) above maximum (59)"},
+		{"a 20~10 * * * * true", "beginning of range (20) beyond end of range (10)"},
+		{"a 0 0 R * * true", "invalid day of month spec"},
+		{"a 0 0 * * ~ true", "invalid day of week spec"},
+	} {
+		_, err := ParseJobs("test", tc.line)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("expected an error containing %q parsing %q, got %v", tc.expected, tc.line, err)
+		}
+	}
+}
+
+func TestShouldRunAtIsPure(t *testing.T) {
+	jobs, err := ParseJobsWithOptions("test", "@seconds\n@splay\na 0 R 2~3 * * * true\nb ~ 0 9 * * * true", ParseOptions{SplaySeed: "host1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2021, time.June, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 3)
+	runs := func() []time.Time {
+		var runs []time.Time
+		for at := start; at.Before(end); at = at.Add(time.Second) {
+			for _, j := range jobs {
+				if j.ShouldRunAt(&at) {
+					runs = append(runs, at)
+				}
+			}
+		}
+		return runs
+	}
+	forwards := runs()
+	if len(forwards) != 6 {
+		t.Fatalf("expected each job to run once a day, got %v", forwards)
+	}
+
+	// Neither the clock nor the order of the calls change the answer.
+	clock = &fakeClock{now: start.AddDate(5, 0, 0)}
+	defer func() { clock = realClock{} }()
+	for i := len(forwards) - 1; i >= 0; i-- {
+		at := forwards[i]
+		before := at.Add(-time.Second)
+		if !jobs[0].ShouldRunAt(&at) && !jobs[1].ShouldRunAt(&at) || jobs[0].ShouldRunAt(&before) || jobs[1].ShouldRunAt(&before) {
+			t.Fatalf("expected runs only at %s when asked in reverse", at)
+		}
+	}
+	if again := runs(); !reflect.DeepEqual(forwards, again) {
+		t.Fatalf("expected the same runs when asked again, got %v then %v", forwards, again)
+	}
+
+	// DayMasks is the seam for the picks, which are single values.
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		second, minute, hour := jobs[1].DayMasks(day)
+		if bits.OnesCount64(second) != 1 || minute != jobs[1].Minute || hour != jobs[1].Hour {
+			t.Fatalf("expected only the second to be picked, got %x %x %x", second, minute, hour)
+		}
+		run := day.Add(9*time.Hour + time.Duration(bits.TrailingZeros64(second))*time.Second)
+		if !jobs[1].ShouldRunAt(&run) {
+			t.Fatalf("expected b to run at the picked %s", run)
+		}
+		_, minute, hour = jobs[0].DayMasks(day)
+		if bits.OnesCount64(minute) != 1 || hour&^(1<<2|1<<3) != 0 || bits.OnesCount64(hour) != 1 {
+			t.Fatalf("expected a single minute and hour 2 or 3, got %x %x", minute, hour)
+		}
+	}
+}
+
+func TestDayMatching(t *testing.T) {
+	// June 2021 starts on a Tuesday.
+	tuesday1 := time.Date(2021, time.June, 1, 0, 0, 0, 0, time.UTC)
+	monday7 := time.Date(2021, time.June, 7, 0, 0, 0, 0, time.UTC)
+	tuesday8 := time.Date(2021, time.June, 8, 0, 0, 0, 0, time.UTC)
+	tuesday15 := time.Date(2021, time.June, 15, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		days string
+		date time.Time
+		runs bool
+	}{
+		// Both unrestricted, every day matches.
+		{"* *", tuesday1, true},
+		{"* *", monday7, true},
+		// Only the day of month restricted.
+		{"15 *", tuesday15, true},
+		{"15 *", tuesday8, false},
+		{"15 ?", tuesday8, false},
+		// Only the day of week restricted.
+		{"* mon", monday7, true},
+		{"* mon", tuesday8, false},
+		{"? mon", tuesday8, false},
+		{"*/1 mon", tuesday8, false},
+		// Both restricted, either matching is enough.
+		{"15 mon", tuesday15, true},
+		{"15 mon", monday7, true},
+		{"15 mon", tuesday8, false},
+		// A range covering the whole month still restricts it.
+		{"1-31 mon", tuesday8, true},
+		{"1 0-6", tuesday8, true},
+		// A stepped star still counts as unrestricted, like in Vixie cron.
+		{"*/2 mon", monday7, true},
+		{"*/2 mon", tuesday15, false},
+		{"*/2 mon", time.Date(2021, time.June, 14, 0, 0, 0, 0, time.UTC), false},
+		{"15 */2", tuesday15, true},
+		{"15 */2", tuesday8, false},
+	} {
+		days := strings.Fields(tc.days)
+		jobs, err := ParseJobs("test", "a 0 0 "+days[0]+" * "+days[1]+" true")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if jobs[0].ShouldRunAt(&tc.date) != tc.runs {
+			t.Fatalf("expected %q to run on %s: %v", tc.days, tc.date.Format("Mon Jan 2"), tc.runs)
+		}
+	}
+
+	for _, tc := range []struct {
+		field string
+		star  bool
+	}{
+		{"*", true},
+		{"?", true},
+		{"*/1", true},
+		{"*/2", true},
+		{"1-31", false},
+		{"1", false},
+		{"1-31/1", false},
+	} {
+		dom, _, err := parseDomField(tc.field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (dom&starBit != 0) != tc.star {
+			t.Fatalf("expected day of month %q to be a star: %v", tc.field, tc.star)
+		}
+		dow, _, err := parseDowField(tc.field)
+		if err != nil && tc.field != "1-31" && tc.field != "1-31/1" {
+			t.Fatal(err)
+		}
+		if err == nil && (dow&starBit != 0) != tc.star {
+			t.Fatalf("expected day of week %q to be a star: %v", tc.field, tc.star)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		line     string
+		expected string
+	}{
+		// Too few fields. There can't be too many, as the command
+		// takes the rest of the line.
+		{"a", "expected a label, timespec and a command"},
+		{"a * * * * *", "expected a label, timespec and a command"},
+		{"a 5 * * * * # comment", "empty command"},
+		// Out of range values.
+		{"a 60 * * * * true", "invalid minute spec: end of range (60) above maximum (59)"},
+		{"a * 24 * * * true", "invalid hour spec: end of range (24) above maximum (23)"},
+		{"a * * 0 * * true", "invalid day of month spec: beginning of range (0) below minimum (1)"},
+		{"a * * 32 * * true", "invalid day of month spec: end of range (32) above maximum (31)"},
+		{"a * * * 13 * true", "invalid month spec: end of range (13) above maximum (12)"},
+		{"a * * * * 8 true", "invalid day of week spec: end of range (8) above maximum (7)"},
+		{"a * * L-31 * * true", "offset from last day (31) above maximum (30)"},
+		{"a * * * * mon#6 true", "occurrence (6) should be between 1 and 5"},
+		// Bad steps and ranges.
+		{"a */0 * * * * true", "step of range should be a positive number"},
+		{"a 0-30/x * * * * true", "failed to parse int from x"},
+		{"a 30-10 * * * * true", "beginning of range (30) beyond end of range (10)"},
+		{"a 1--2 * * * * true", "too many hyphens"},
+		{"a 1/2/3 * * * * true", "too many slashes"},
+		// Unknown names, and names in fields without them.
+		{"a * * * foo * true", "invalid month spec: failed to parse int from foo"},
+		{"a * * * * funday true", "invalid day of week spec: failed to parse int from funday"},
+		{"a jan * * * * true", "invalid minute spec: failed to parse int from jan"},
+		// Negative numbers.
+		{"a -1 * * * * true", "invalid minute spec: negative numbers are not allowed: -1"},
+		{"a * * * * -0 true", "invalid day of week spec: negative numbers are not allowed"},
+	} {
+		_, err := ParseJobs("test", tc.line)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("expected an error containing %q parsing %q, got %v", tc.expected, tc.line, err)
+		}
+	}
+}
+
+func TestParseErrorContext(t *testing.T) {
+	_, err := ParseJobs("test", "job x * * * * true")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	expected := "parse error test:1:5 invalid minute spec: failed to parse int from x\n\tjob x * * * * true\n\t    ^"
+	if err.Error() != expected {
+		t.Fatalf("expected error %q, got %q", expected, err.Error())
+	}
+
+	_, err = ParseJobs("test", "job * * * *")
+	if err == nil || err.Error() != "parse error test:1 expected a label, timespec and a command\n\tjob * * * *" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestParseLineNumbers(t *testing.T) {
+	for _, tc := range []struct {
+		tab      string
+		expected string
+	}{
+		{"# comment\n\nbad * * * * true", "test:3 "},
+		{"# comment\n\nbad x * * * * true", "test:3:5 "},
+		{"# comment\n\n1BAD=x\na * * * * * true", "test:3 "},
+		{"# comment\n\n@jitter bad\na * * * * * true", "test:3 "},
+		{"# comment\n\n@jitter 1s", "test:3 "},
+		{"a * * * * * true\n\na * * * * * true", "first used at test:1"},
+	} {
+		_, err := ParseJobs("test", tc.tab)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("expected an error containing %q parsing %q, got %v", tc.expected, tc.tab, err)
+		}
+	}
+}
+
+func TestParseCommandComments(t *testing.T) {
+	for _, tc := range []struct {
+		line    string
+		command string
+	}{
+		{"a * * * * * echo hello # says hello", "echo hello"},
+		{"a * * * * * echo hello\t#tab", "echo hello"},
+		{"a * * * * * curl http://example.com/#fragment", "curl http://example.com/#fragment"},
+		{"a * * * * * echo \\# not a comment", "echo \\# not a comment"},
+		{"a * * * * * echo '# quoted' \"# double\" # comment", "echo '# quoted' \"# double\""},
+		{"a * * * * * echo \"a \\\" # still quoted\"", "echo \"a \\\" # still quoted\""},
+		{"a * * * * * echo a#b", "echo a#b"},
+	} {
+		jobs, err := ParseJobs("test", tc.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if jobs[0].Command != tc.command {
+			t.Fatalf("expected command %q parsing %q, got %q", tc.command, tc.line, jobs[0].Command)
+		}
+	}
+
+	_, err := ParseJobs("test", "a * * * * * # only a comment")
+	if err == nil {
+		t.Fatal("expected an error for a job with no command")
+	}
+}
+
+func TestParseCommentLines(t *testing.T) {
+	tab := "# hash\n; semicolon\n  # indented\n\t; tab indented\n;\n#\na * * * * * true\n  ; after\\\nb * * * * * true"
+	jobs, err := ParseJobs("test", tab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].Name != "a" || jobs[1].Name != "b" {
+		t.Fatalf("expected only jobs a and b, got %v", jobs)
+	}
+
+	jobs, err = ParseJobs("test", "  ; desc: Indented description\na * * * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs[0].Description != "Indented description" {
+		t.Fatalf("expected a description, got %q", jobs[0].Description)
+	}
+}
+
+func TestParseWhitespaceLines(t *testing.T) {
+	for _, tab := range []string{
+		" ",
+		"\t",
+		" \t \r",
+		"\r",
+		"\v\f",
+		" #",
+		"\t# indented comment",
+		"   ;",
+		" \\\n ",
+	} {
+		jobs, err := ParseJobs("test", tab)
+		if err != nil {
+			t.Fatalf("%q: %s", tab, err)
+		}
+		if len(jobs) != 0 {
+			t.Fatalf("%q: expected no jobs, got %d", tab, len(jobs))
+		}
+	}
+
+	jobs, err := ParseJobs("test", "  # leading comment\n\t@jitter 10s\n  a * * * * * true\n \t \n\t# trailing comment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].MaxJitter != 10*time.Second {
+		t.Fatalf("expected an indented directive to apply to the job, got %v", jobs)
+	}
+}
+
+func TestParseDescriptions(t *testing.T) {
+	tab := `# desc: Back up the database
+# desc:   to S3.
+@retry 3 1m
+backup 0 2 * * * true
+# desc: dropped by the blank line
+
+plain 0 3 * * * true
+# desc: dropped by the comment
+# just a comment
+other 0 4 * * * true
+#desc:tight
+tight 0 5 * * * true`
+	jobs, err := ParseJobs("test", tab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{"Back up the database to S3.", "", "", "tight"} {
+		if jobs[i].Description != expected {
+			t.Fatalf("job %s has description %q, expected %q", jobs[i].Name, jobs[i].Description, expected)
+		}
+	}
+}
+
+func TestParseQuestionMark(t *testing.T) {
+	jobs, err := ParseJobs("test", "dom 0 0 ? * mon true\ndow 0 0 15 * ? true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		job  *Job
+		date string
+		runs bool
+	}{
+		{jobs[0], "2021-06-07", true},  // A Monday.
+		{jobs[0], "2021-06-15", false}, // A Tuesday.
+		{jobs[1], "2021-06-15", true},
+		{jobs[1], "2021-06-07", false},
+	} {
+		d, err := time.Parse("2006-01-02", tc.date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.job.ShouldRunAt(&d) != tc.runs {
+			t.Fatalf("expected job %s to run on %s: %v", tc.job.Name, tc.date, tc.runs)
+		}
+	}
+
+	for _, tab := range []string{
+		"a ? 0 * * * true",
+		"a 0 ? * * * true",
+		"a 0 0 * ? * true",
+		"a 0 0 ?,1 * * true",
+		"a 0 0 * * ?-1 true",
+	} {
+		_, err := ParseJobs("test", tab)
+		if err == nil {
+			t.Fatalf("expected an error parsing %q", tab)
+		}
+	}
+}
+
+func TestParseDayWarning(t *testing.T) {
+	var warnings []string
+	opts := ParseOptions{Warn: func(msg string) { warnings = append(warnings, msg) }}
+	_, err := ParseJobsWithOptions("test", "either 0 0 1 * mon true\ndom 0 0 1 * * true\ndow 0 0 * * mon true", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "test:1 job either ") {
+		t.Fatalf("expected a single warning about job either, got %q", warnings)
+	}
+
+	warnings = nil
+	opts.DayAnd = true
+	jobs, err := ParseJobsWithOptions("test", "both 0 0 1 * mon true", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 0 {
+		t.Fatalf("expected no warnings, got %q", warnings)
+	}
+	monday := time.Date(2021, 6, 7, 0, 0, 0, 0, time.UTC)
+	firstMonday := time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)
+	if jobs[0].ShouldRunAt(&monday) || !jobs[0].ShouldRunAt(&firstMonday) {
+		t.Fatal("expected the job to run only on mondays that are the first of the month")
+	}
+}
+
+func TestParseMinInterval(t *testing.T) {
+	opts := ParseOptions{MinInterval: 5 * time.Minute}
+	for _, tab := range []string{
+		"a */5 * * * * true",
+		"a 0 9 * * mon-fri true",
+		"a 0,30 * * * * true",
+		"@disabled\na * * * * * true",
+		"@keepalive\na * * * * * true",
+		"a 0 0 30 feb * true",
+	} {
+		_, err := ParseJobsWithOptions("test", tab, opts)
+		if err != nil {
+			t.Fatalf("%q: %s", tab, err)
+		}
+	}
+	for _, tc := range []struct {
+		tab      string
+		expected string
+	}{
+		{"a * * * * * true", "parse error test:1 job a runs every 1m0s, more often than the minimum interval of 5m0s"},
+		{"a * 9 * * * true", "job a runs every 1m0s"},
+		{"a 0,2 * * * * true", "job a runs every 2m0s"},
+		{"b 0 0 * * * true\na */4 * * * * true", "parse error test:2 job a runs every 4m0s"},
+	} {
+		_, err := ParseJobsWithOptions("test", tc.tab, opts)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("%q: expected an error containing %q, got %v", tc.tab, tc.expected, err)
+		}
+	}
+
+	_, err := ParseJobsWithOptions("test", "a */10 * * * * * true", ParseOptions{Seconds: true, MinInterval: time.Minute})
+	if err == nil || !strings.Contains(err.Error(), "runs every 10s") {
+		t.Fatalf("expected a seconds job to be too frequent, got %v", err)
+	}
+}
+
+func TestCanRun(t *testing.T) {
+	for _, tc := range []struct {
+		tab    string
+		dayAnd bool
+		canRun bool
+	}{
+		{"a 0 0 30 feb * true", false, false},
+		{"a 0 0 31 feb * true", false, false},
+		{"a 0 0 31 apr,jun,sep,nov * true", false, false},
+		{"a 0 0 31 apr,may * true", false, true},
+		{"a 0 0 29 feb * true", false, true},
+		{"a 0 0 30 feb mon true", false, true},
+		{"a 0 0 30 feb mon true", true, false},
+		{"a 0 0 * feb mon#5 true", false, true},
+		{"a 0 0 L-30 * * true", false, true},
+	} {
+		jobs, err := ParseJobsWithOptions("test", tc.tab, ParseOptions{DayAnd: tc.dayAnd})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if jobs[0].CanRun() != tc.canRun {
+			t.Fatalf("expected CanRun of %q with DayAnd %v to be %v", tc.tab, tc.dayAnd, tc.canRun)
+		}
+	}
+
+	var warnings []string
+	_, err := ParseJobsWithOptions("test", "a 0 0 30 feb * true", ParseOptions{Warn: func(msg string) { warnings = append(warnings, msg) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "can never run") {
+		t.Fatalf("expected a warning that the job can never run, got %q", warnings)
+	}
+}
+
+func TestParseURLInclude(t *testing.T) {
+	_, err := ParseJobs("https://example.com/tab", "@include other")
+	if err == nil || !strings.Contains(err.Error(), "must be absolute") {
+		t.Fatalf("expected a relative include from a URL to fail, got %v", err)
+	}
+}
+
+func TestParseTabs(t *testing.T) {
+	jobs, err := ParseTabsWithOptions([]Tab{
+		{Name: "one", Data: "@seconds\nA=1\na * * * * * * true"},
+		{Name: "two", Data: "b * * * * * true"},
+	}, ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[1].Second != 0 || len(jobs[1].Env) != 0 {
+		t.Fatalf("expected the second table to start afresh, got %d jobs", len(jobs))
+	}
+
+	_, err = ParseTabsWithOptions([]Tab{
+		{Name: "one", Data: "a * * * * * true"},
+		{Name: "two", Data: "\na * * * * * true"},
+	}, ParseOptions{})
+	if err == nil || !strings.Contains(err.Error(), "two:2:1 duplicate job name a, first used at one:1") {
+		t.Fatalf("expected a duplicate name error, got %v", err)
+	}
+}
+
+func TestStartDoesNotBlock(t *testing.T) {
+	jobs := make([]*Job, 50)
+	start := time.Now()
+	for i := range jobs {
+		jobs[i] = &Job{Name: "test", Command: "sleep 0.5"}
+		jobs[i].Start(func(string, time.Duration, *exec.Cmd, error) {})
+	}
+	elapsed := time.Since(start)
+	for _, j := range jobs {
+		if !j.IsRunning() {
+			t.Fatal("expected the job to be running")
+		}
+	}
+	for _, j := range jobs {
+		j.Wait()
+	}
+	if elapsed > 250*time.Millisecond {
+		t.Fatalf("starting 50 jobs took %s", elapsed)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var restartCounter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "promcron_job_restart_count",
+		Help: "Count of times a @keepalive job has been restarted after exiting.",
+	},
+	[]string{"job"},
+)
+
+const (
+	// A @keepalive job that exits is restarted after a backoff, that
+	// doubles each time up to the maximum, unless the job stayed up for
+	// long enough that it seems to have been working.
+	minRestartBackoff = time.Second
+	maxRestartBackoff = time.Minute
+	resetRestartAfter = time.Minute
+)
+
+// supervisor keeps a @keepalive job running until it is stopped.
+type supervisor struct {
+	job  *Job
+	stop chan struct{}
+}
+
+// supervisors are only used by the scheduler, so need no locking.
+var supervisors = make(map[string]*supervisor)
+
+// superviseJobs stops the current supervisors and supervises the
+// @keepalive jobs in jobs instead, so reloading restarts them. A job
+// replacing one of the same name waits for the old process to exit.
+func superviseJobs(jobs []*Job, done <-chan struct{}) {
+	old := supervisors
+	supervisors = make(map[string]*supervisor)
+	for _, s := range old {
+		close(s.stop)
+	}
+	for _, j := range jobs {
+		if !j.KeepAlive || j.Disabled {
+			continue
+		}
+		s := &supervisor{job: j, stop: make(chan struct{})}
+		supervisors[j.Name] = s
+		var prev *Job
+		if o, ok := old[j.Name]; ok {
+			prev = o.job
+		}
+		go s.run(prev, done)
+	}
+}
+
+func (s *supervisor) run(prev *Job, done <-chan struct{}) {
+	j := s.job
+	if *dryRun {
+		dispatchJob(j, time.Time{}, 0, 0, done)
+		return
+	}
+	if prev != nil {
+		prev.Wait()
+	}
+	backoff := minRestartBackoff
+	for {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		started := time.Now()
+		dispatchJob(j, time.Time{}, 0, 0, done)
+		exited := make(chan struct{})
+		go func() {
+			j.Wait()
+			close(exited)
+		}()
+		select {
+		case <-exited:
+		case <-s.stop:
+			// The process may not have started yet, so wait for it
+			// before asking it to exit.
+			for !j.started() {
+				select {
+				case <-exited:
+					return
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+			j.Signal(syscall.SIGTERM)
+			return
+		}
+		if time.Since(started) >= resetRestartAfter {
+			backoff = minRestartBackoff
+		}
+		logEvent("warn", "job_restart", logFields{"job": j.Name, "backoff": backoff.Seconds()},
+			"job %s exited, restarting in %s", j.Name, backoff)
+		if !sleepUnlessDone(backoff, s.stop) {
+			return
+		}
+		restartCounter.WithLabelValues(j.Name).Inc()
+		backoff *= 2
+		if backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
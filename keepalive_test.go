@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestKeepAlive(t *testing.T) {
+	jobs, err := ParseJobs("test", "@keepalive\nkeepalive-test * * * * * exit 1\n@keepalive\nkeepalive-daemon * * * * * exec sleep 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exiting, daemon := jobs[0], jobs[1]
+	now := time.Now()
+	if exiting.ShouldRunAt(&now) {
+		t.Fatal("expected a @keepalive job not to be scheduled")
+	}
+	for _, j := range jobs {
+		initJobMetrics(j.Name)
+		defer deleteJobMetrics(j.Name)
+	}
+
+	done := make(chan struct{})
+	superviseJobs(jobs, done)
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(restartCounter.WithLabelValues(exiting.Name)) < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the exiting job to be restarted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !daemon.IsRunning() {
+		t.Fatal("expected the daemon to be kept running")
+	}
+
+	close(done)
+	superviseJobs(nil, done)
+	stopped := make(chan struct{})
+	go func() {
+		daemon.Wait()
+		exiting.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected stopping the supervisors to stop the daemon")
+	}
+	if v := testutil.ToFloat64(restartCounter.WithLabelValues(daemon.Name)); v != 0 {
+		t.Fatalf("expected the daemon not to be restarted, got %v restarts", v)
+	}
+
+	_, err = ParseJobs("test", "@keepalive\n@retry 3 1s\nboth * * * * * true")
+	if err == nil {
+		t.Fatal("expected @keepalive with @retry to be an error")
+	}
+}
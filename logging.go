@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// logFields are extra structured fields for a JSON log line.
+type logFields map[string]interface{}
+
+var (
+	// jsonLogs is set by -log-format json.
+	jsonLogs    bool
+	jsonLogLock sync.Mutex
+	// jsonLogOutput is where JSON log lines are written.
+	jsonLogOutput io.Writer = os.Stderr
+)
+
+// logEvent logs a scheduler event. With -log-format json the
+// event name and fields are included in the JSON object, otherwise
+// only the message is logged, as with log.Printf.
+func logEvent(level, event string, fields logFields, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if !jsonLogs {
+		log.Print(msg)
+		return
+	}
+	writeJSONLog(level, event, msg, fields)
+}
+
+func writeJSONLog(level, event, msg string, fields logFields) {
+	obj := logFields{}
+	for k, v := range fields {
+		obj[k] = v
+	}
+	obj["time"] = time.Now().Format(time.RFC3339Nano)
+	obj["level"] = level
+	obj["event"] = event
+	obj["msg"] = msg
+	line, err := json.Marshal(obj)
+	if err != nil {
+		line, _ = json.Marshal(logFields{"level": "error", "event": "log_error", "msg": err.Error()})
+	}
+	jsonLogLock.Lock()
+	defer jsonLogLock.Unlock()
+	jsonLogOutput.Write(append(line, '\n'))
+}
+
+// jsonLogWriter turns lines from the standard logger into
+// JSON log lines, so plain log.Printf calls stay parseable.
+type jsonLogWriter struct{}
+
+func (jsonLogWriter) Write(b []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(b, "\n"), []byte("\n")) {
+		writeJSONLog("info", "message", string(line), nil)
+	}
+	return len(b), nil
+}
+
+func setLogFormat(format string) error {
+	switch format {
+	case "text":
+		jsonLogs = false
+	case "json":
+		jsonLogs = true
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{})
+	default:
+		return fmt.Errorf("unknown log format %q, expected 'text' or 'json'", format)
+	}
+	return nil
+}
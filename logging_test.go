@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLogFormat(t *testing.T) {
+	defer func() {
+		jsonLogs = false
+		jsonLogOutput = os.Stderr
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(os.Stderr)
+	}()
+	for _, tc := range []struct {
+		format string
+		log    func()
+		// expected is the text line, or the JSON fields besides time.
+		expected interface{}
+	}{
+		{"text", func() { logEvent("warn", "job_skipped", logFields{"job": "a"}, "skipping %s", "a") }, "skipping a\n"},
+		{"json", func() { logEvent("warn", "job_skipped", logFields{"job": "a"}, "skipping %s", "a") }, map[string]interface{}{
+			"level": "warn", "event": "job_skipped", "msg": "skipping a", "job": "a",
+		}},
+		// Plain log calls still give parseable lines.
+		{"json", func() { log.Printf("plain") }, map[string]interface{}{
+			"level": "info", "event": "message", "msg": "plain",
+		}},
+	} {
+		var buf bytes.Buffer
+		jsonLogOutput = &buf
+		log.SetOutput(&buf)
+		err := setLogFormat(tc.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.format == "text" {
+			log.SetFlags(0)
+		}
+		tc.log()
+		if expected, ok := tc.expected.(string); ok {
+			if buf.String() != expected {
+				t.Fatalf("expected %q, got %q", expected, buf.String())
+			}
+			continue
+		}
+		var got map[string]interface{}
+		err = json.Unmarshal(buf.Bytes(), &got)
+		if err != nil {
+			t.Fatalf("expected a JSON line, got %q: %s", buf.String(), err)
+		}
+		if _, ok := got["time"]; !ok {
+			t.Fatalf("expected a time field, got %v", got)
+		}
+		delete(got, "time")
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Fatalf("expected %v, got %v", tc.expected, got)
+		}
+	}
+
+	err := setLogFormat("xml")
+	if err == nil || !strings.Contains(err.Error(), "unknown log format") {
+		t.Fatalf("expected an unknown format error, got %v", err)
+	}
+}
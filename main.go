@@ -1,14 +1,26 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,12 +31,97 @@ import (
 
 // flags
 var (
-	printSchedule    = flag.Bool("print-schedule", false, "Print the schedule for the next 24 hours then exit.")
-	printScheduleFor = flag.Duration("print-schedule-for", 0*time.Second, "Print the schedule for the specified duration then exit.")
-	metricsAddress   = flag.String("prometheus-metrics", "", "address:port to serve job prometheus metrics on.")
-	tab              = flag.String("f", "/etc/promcron", "'promcron' file to load and run.")
+	printVersion        = flag.Bool("version", false, "Print version information then exit.")
+	explain             = flag.String("explain", "", "Describe the given timespec in plain English then exit.")
+	dumpParsed          = flag.Bool("dump-parsed", false, "Print the parsed fields of each job then exit, for debugging timespecs.")
+	printSchedule       = flag.Bool("print-schedule", false, "Print the schedule for the next 24 hours then exit.")
+	printScheduleJSON   = flag.Bool("print-schedule-json", false, "Print the schedule as a JSON array then exit, for the duration given by -print-schedule-for.")
+	runJob              = flag.String("run", "", "Run the named job once then exit with its exit status.")
+	printNext           = flag.Bool("next", false, "Print the next run of each job then exit.")
+	nextHorizon         = flag.Duration("next-horizon", 366*24*time.Hour, "How far ahead -next looks for a job's next run.")
+	dryRun              = flag.Bool("dry-run", false, "Log the jobs that would be started instead of running them.")
+	checkCmds           = flag.Bool("check-commands", false, "Check the shell syntax of every job's command on startup, exiting if any are invalid.")
+	check               = flag.Bool("check", false, "Check the 'promcron' file for errors then exit.")
+	printScheduleFor    = flag.Duration("print-schedule-for", 0*time.Second, "Print the schedule for the specified duration then exit.")
+	tlsCert             = flag.String("tls-cert", "", "Certificate file to serve metrics over HTTPS with, requires -tls-key.")
+	tlsKey              = flag.String("tls-key", "", "Private key file for -tls-cert.")
+	metricsAuth         = flag.String("metrics-auth", "", "user:password required with HTTP basic auth to access metrics.")
+	metricsAddress      = flag.String("prometheus-metrics", "", "address:port, or unix:PATH for a unix socket, to serve job prometheus metrics on.")
+	tabDir              = flag.String("d", "", "Directory of 'promcron' files to load and run, in name order, after any -f files.")
+	seconds             = flag.Bool("seconds", false, "Expect a leading seconds field in every job timespec.")
+	maxConcurrent       = flag.Int("max-concurrent", 0, "Maximum number of jobs to run at once, 0 for no limit.")
+	groupPolicy         = flag.String("group-policy", "queue", "What to do with jobs due while another job in their @group is running, 'queue' or 'skip'.")
+	concurrencyPolicy   = flag.String("concurrency-policy", "queue", "What to do with jobs over the -max-concurrent limit, 'queue' or 'skip'.")
+	logDir              = flag.String("log-dir", "", "Append job output to <dir>/<job>.log instead of stderr, for jobs without an @log directive.")
+	logTimestamps       = flag.Bool("log-timestamps", false, "Prefix each line of job output with the time.")
+	prefixOutput        = flag.Bool("prefix-output", false, "Prefix each line of job output with '[<job>] '.")
+	pushgateway         = flag.String("pushgateway", "", "Pushgateway URL to push a job's metrics to after each run.")
+	pushgatewayInstance = flag.String("pushgateway-instance", "", "Instance label for metrics pushed to the Pushgateway, defaults to the hostname.")
+	runLogPath          = flag.String("runlog", "", "File to append a JSON line to for every finished job run.")
+	textfile            = flag.String("textfile", "", "File to write metrics to after each job run, for the node_exporter textfile collector.")
+	logFormat           = flag.String("log-format", "text", "Log format, 'text' or 'json'.")
+	forwardSignals      = flag.Bool("forward-signals", false, "Forward the shutdown signal to running jobs.")
+	shutdownGrace       = flag.Duration("shutdown-grace", 0*time.Second, "How long to wait for running jobs on shutdown before terminating them, 0 to wait forever.")
+	timeJumpCommand     = flag.String("time-jump-command", "", "Shell command to run when a time jump of at least -time-jump-threshold is detected.")
+	timeJumpThreshold   = flag.Duration("time-jump-threshold", 5*time.Minute, "Smallest time jump that runs the -time-jump-command.")
+	stateFile           = flag.String("state-file", "", "File to remember scheduler state in across restarts.")
+	catchup             = flag.Bool("catchup", false, "On startup, run jobs that were missed since the last check recorded in the -state-file.")
+	catchupMax          = flag.Int("catchup-max", 1, "Maximum number of missed runs of each job to catch up on.")
+	outputLimit         = flag.String("output-limit", "0", "Bytes of output to keep from each job run, with an optional K, M or G suffix, for jobs without an @output-limit directive. 0 for no limit.")
+	expandEnv           = flag.Bool("expand-env", false, "Expand $VAR and ${VAR} in commands when loading the table, rather than leaving them to the shell.")
+	strictEnv           = flag.Bool("strict-env", false, "Make -expand-env of an undefined variable an error.")
+	splay               = flag.Bool("splay", false, "Shift every job's schedule by a number of minutes picked from the hostname, as if it had an @splay directive.")
+	splaySeed           = flag.String("splay-seed", "", "Pick @splay shifts and random R values from this rather than the hostname.")
+	fetchTimeout        = flag.Duration("fetch-timeout", 30*time.Second, "Timeout for fetching -f tables given as http or https URLs.")
+	tickOffset          = flag.Duration("tick-offset", 30*time.Second, "How far into each minute to check for due jobs.")
+	minInterval         = flag.Duration("min-interval", 0, "Reject tables with jobs scheduled to run more often than this, zero for no limit.")
+	watch               = flag.Bool("watch", false, "Reload the tables when they change on disk, as well as on SIGHUP.")
+	startLead           = flag.Duration("start-lead", 0, "How much earlier than usual to check for and start due jobs, to make up for slow starts.")
+	alignStarts         = flag.Bool("align-starts", false, "Start jobs at the top of the minute they are due, rather than at the check.")
+	dayAnd              = flag.Bool("day-and", false, "Run jobs that restrict both the day of month and day of week only on days matching both.")
+	maxJitter           = flag.Duration("max-jitter", 0*time.Second, "Delay job starts by a random duration up to this, for jobs without an @jitter directive.")
+	defaultTimeout      = flag.Duration("default-timeout", 0, "Kill runs taking longer than this, for jobs without an @timeout directive, zero for no limit.")
+	failIfUnhealthy     = flag.Bool("fail-if-unhealthy", false, "On shutdown, exit with a nonzero status if any job's last run failed or it never succeeded.")
 )
 
+// tabs are the 'promcron' files given by -f.
+var tabs tabFiles
+
+func init() {
+	flag.Var(&tabs, "f", "'promcron' file to load and run, an http or https URL to fetch it from, or - to read it from stdin. May be repeated, and defaults to /etc/promcron without a -d.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), signalUsage)
+	}
+}
+
+const signalUsage = `
+Signals:
+  SIGHUP
+    	Reload the tables.
+  SIGUSR1
+    	Log the status of each job.
+  SIGINT, SIGTERM
+    	Shut down once running jobs finish, a second signal forces it.
+`
+
+// state is remembered across restarts, it is nil without a -state-file.
+var state *State
+
+// jobSlots limits how many jobs run at once, it is nil when there is no limit.
+var jobSlots chan struct{}
+
+// reloadRequests asks the scheduler to reload the table.
+var reloadRequests = make(chan struct{}, 1)
+
+// schedulerRunning is set while the scheduler loop is running.
+var schedulerRunning int32
+
+// tickInterval is how often the scheduler checks for due jobs,
+// it drops to one second when any job has a seconds field.
+var tickInterval = time.Minute
+
 // metrics
 var (
 	forwardTimeSkips = promauto.NewCounter(prometheus.CounterOpts{
@@ -35,6 +132,27 @@ var (
 		Name: "promcron_backward_time_skips",
 		Help: "Detected anomalies where time moved backward causing potential job duplicates.",
 	})
+	startTimeGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "promcron_start_time_seconds",
+		Help: "Unix time promcron started.",
+	})
+	jobsConfiguredGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "promcron_jobs_configured",
+		Help: "Number of jobs in the loaded table.",
+	})
+	lastTickGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "promcron_scheduler_last_tick_timestamp_seconds",
+		Help: "Unix time the scheduler last checked for due jobs.",
+	})
+	tickDurationHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "promcron_scheduler_tick_duration_seconds",
+		Help:    "Time taken to check for and start due jobs at each scheduler tick.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	})
+	timeJumpGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "promcron_time_jump_seconds",
+		Help: "Size of the last detected time anomaly, negative when time moved backward.",
+	})
 	overdueCounter = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "promcron_job_overdue_count",
@@ -49,6 +167,13 @@ var (
 		},
 		[]string{"job"},
 	)
+	consecutiveFailuresGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "promcron_job_consecutive_failures",
+			Help: "Times a job has failed since it last succeeded.",
+		},
+		[]string{"job"},
+	)
 	successCounter = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "promcron_job_success_count",
@@ -86,51 +211,866 @@ var (
 	)
 	runningGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "promcron_job_running",
-		Help: "Whether or not the job is currently running.",
+		Help: "Whether or not the job is currently running, or how many runs are for parallel jobs.",
+	},
+		[]string{"job"})
+	currentRunStartGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "promcron_job_current_run_start_timestamp_seconds",
+		Help: "When the current run of the job started, zero if it isn't running.",
 	},
 		[]string{"job"})
+	runningSecondsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "promcron_job_running_seconds",
+		Help: "How long the current run of the job has been going as of the last check, zero if it isn't running.",
+	},
+		[]string{"job"})
+	runningJobsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "promcron_jobs_running_total",
+		Help: "Number of jobs currently running.",
+	})
+	queuedJobsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "promcron_jobs_queued",
+		Help: "Number of jobs waiting for the -max-concurrent limit.",
+	})
+	retryCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "promcron_job_retry_count",
+			Help: "Times a failed job has been retried.",
+		},
+		[]string{"job"},
+	)
+	startErrorCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "promcron_job_start_error_count",
+			Help: "Times a job failed without its command running, such as when it could not be executed.",
+		},
+		[]string{"job"},
+	)
+	skippedDependencyCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "promcron_job_skipped_dependency_count",
+			Help: "Times a job was skipped because the last run of the job it requires did not succeed.",
+		},
+		[]string{"job"},
+	)
+	configReloadsCounter = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "promcron_config_reloads_total",
+			Help: "Times the tables have been reloaded, successfully or not.",
+		},
+	)
+	configReloadSuccessGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "promcron_config_reload_success",
+			Help: "Whether the last reload of the tables succeeded.",
+		},
+	)
+	timeoutCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "promcron_job_timeout_count",
+			Help: "Times a run of a job was killed for taking longer than its timeout.",
+		},
+		[]string{"job"},
+	)
+	skippedFlagFileCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "promcron_job_skipped_flagfile_count",
+			Help: "Times a job was skipped because of its @skip-if-exists or @run-if-exists file.",
+		},
+		[]string{"job"},
+	)
+	slowCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "promcron_job_slow_count",
+			Help: "Times a job took longer than its @max-duration.",
+		},
+		[]string{"job"},
+	)
+	lastRunGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "promcron_job_last_run_timestamp_seconds",
+			Help: "Unix time the last job execution finished.",
+		},
+		[]string{"job"},
+	)
+	lastSuccessGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "promcron_job_last_success_timestamp_seconds",
+			Help: "Unix time the last successful job execution finished.",
+		},
+		[]string{"job"},
+	)
+	outputBytesCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "promcron_job_output_bytes",
+			Help: "Bytes of output written by a job to stdout and stderr, including output dropped by an output limit.",
+		},
+		[]string{"job"},
+	)
+	enabledGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "promcron_job_enabled",
+			Help: "Whether the job is scheduled, 0 when it has an @disabled directive.",
+		},
+		[]string{"job"},
+	)
+	jitterGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "promcron_job_jitter_seconds",
+			Help: "Random delay applied to the start of the last job execution.",
+		},
+		[]string{"job"},
+	)
+	scheduleDriftGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "promcron_job_schedule_drift_seconds",
+			Help: "How long after its scheduled time the last scheduled job execution was dispatched.",
+		},
+		[]string{"job"},
+	)
 )
 
 func delayTillNextCheck(fromt time.Time) time.Duration {
-	// Schedule for midway in the next minute to be
+	// Schedule for midway in the next tick by default to be
 	// resilient to clock adjustments in both directions.
-	return 30*time.Second +
-		(time.Duration(60-fromt.Second()) * time.Second) -
-		(time.Duration(fromt.Nanosecond()%1000000000) * time.Nanosecond)
+	checkOffset := tickInterval / 2
+	if tickInterval == time.Minute {
+		checkOffset = minuteCheckOffset()
+	}
+	checkOffset -= checkLead(checkOffset)
+	offset := (time.Duration(fromt.Second())*time.Second +
+		time.Duration(fromt.Nanosecond())) % tickInterval
+	return checkOffset + tickInterval - offset
 }
 
-func onJobExit(jobName string, duration time.Duration, cmd *exec.Cmd, err error) {
+// minuteCheckOffset is how far into each minute jobs without a seconds
+// field are checked, -tick-offset clamped to within the minute.
+func minuteCheckOffset() time.Duration {
+	if *tickOffset < 0 {
+		return 0
+	}
+	if *tickOffset >= time.Minute {
+		return time.Minute - 1
+	}
+	return *tickOffset
+}
 
-	exitStatus := 127
-	if err != nil {
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				exitStatus = status.ExitStatus()
+// checkLead is -start-lead clamped to the given check offset, so an
+// early check never moves into the previous tick.
+func checkLead(checkOffset time.Duration) time.Duration {
+	if *startLead < 0 {
+		return 0
+	}
+	if *startLead > checkOffset {
+		return checkOffset
+	}
+	return *startLead
+}
+
+// jobDue reports whether j should start at the check for time t.
+// When ticking every second, jobs without a seconds field are only
+// considered at the -tick-offset second of each minute, as they would
+// be normally, or at the top of the minute with -align-starts.
+func jobDue(j *Job, t *time.Time) bool {
+	second := int(minuteCheckOffset() / time.Second)
+	if *alignStarts {
+		second = 0
+	}
+	if j.Second == 0 && tickInterval != time.Minute && t.Second() != second {
+		return false
+	}
+	return j.ShouldRunAt(t)
+}
+
+// runningFor is how long the longest current run of j, or of a job of
+// the same name from before a reload, has been going.
+func runningFor(j *Job, retired []*Job) time.Duration {
+	now := time.Now()
+	var longest time.Duration
+	for _, r := range append([]*Job{j}, retired...) {
+		if r.Name != j.Name {
+			continue
+		}
+		if start, ok := r.RunningSince(); ok && now.Sub(start) > longest {
+			longest = now.Sub(start)
+		}
+	}
+	return longest
+}
+
+// flagFileSkip says why j should be skipped because of its
+// @skip-if-exists or @run-if-exists file, or is empty if it shouldn't.
+func flagFileSkip(j *Job) string {
+	if j.SkipIfExists != "" {
+		if _, err := os.Stat(j.SkipIfExists); err == nil {
+			return fmt.Sprintf("%s exists", j.SkipIfExists)
+		}
+	}
+	if j.RunIfExists != "" {
+		if _, err := os.Stat(j.RunIfExists); err != nil {
+			return fmt.Sprintf("%s does not exist", j.RunIfExists)
+		}
+	}
+	return ""
+}
+
+// dueTime is the time jobs due at the check for time t are scheduled
+// for, which with -align-starts is the start of the tick, when they
+// are started.
+func dueTime(t time.Time) time.Time {
+	if *alignStarts {
+		return t.Truncate(tickInterval)
+	}
+	return t
+}
+
+// scheduledTime is the time in j's schedule that it is due for at the
+// check for due, the start of the minute, or of the second for jobs with
+// a seconds field.
+func scheduledTime(j *Job, due time.Time) time.Time {
+	if j.Second == 0 {
+		return due.Truncate(time.Minute)
+	}
+	return due.Truncate(time.Second)
+}
+
+// chooseJitter picks a random start delay for j that is less than
+// both the job's maximum jitter and limit.
+func chooseJitter(j *Job, limit time.Duration) time.Duration {
+	maxJitter := j.MaxJitter
+	if maxJitter > limit {
+		maxJitter = limit
+	}
+	if maxJitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(maxJitter)))
+}
+
+// sleepUnlessDone sleeps for d, returning false if done is closed first.
+func sleepUnlessDone(d time.Duration, done <-chan struct{}) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// acquireJobSlot takes one of the -max-concurrent slots, waiting for one
+// to become free if the policy is to queue. It returns false if the
+// job should not be run.
+func acquireJobSlot(jobName string, done <-chan struct{}) bool {
+	if jobSlots == nil {
+		return true
+	}
+	select {
+	case jobSlots <- struct{}{}:
+		return true
+	default:
+	}
+	if *concurrencyPolicy == "skip" {
+		logEvent("warn", "job_skip", logFields{"job": jobName}, "skipping job %s, %d jobs already running", jobName, cap(jobSlots))
+		return false
+	}
+	logEvent("info", "job_queue", logFields{"job": jobName}, "queueing job %s, %d jobs already running", jobName, cap(jobSlots))
+	queuedJobsGauge.Inc()
+	defer queuedJobsGauge.Dec()
+	select {
+	case jobSlots <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func releaseJobSlot() {
+	if jobSlots != nil {
+		<-jobSlots
+	}
+}
+
+// dispatchJob starts j after waiting for align and then the given
+// jitter, once it has a job slot. With -dry-run it only logs that
+// it would have. Scheduled is when the run was due, for
+// promcron_job_schedule_drift_seconds, or zero for runs that weren't
+// scheduled, like catch-up runs.
+func dispatchJob(j *Job, scheduled time.Time, align, jitter time.Duration, done <-chan struct{}) {
+	if *dryRun {
+		logEvent("info", "job_dry_run", logFields{"job": j.Name}, "dry run: would start job %s", j.Name)
+		return
+	}
+	if jitter > 0 {
+		logEvent("info", "job_delay", logFields{"job": j.Name, "delay": jitter.Seconds()}, "delaying job %s by %s", j.Name, jitter)
+	}
+	// Finish heartbeats wait for the start heartbeat, so they arrive in order.
+	var heartbeatStarted <-chan struct{}
+	j.StartWhen(func() bool {
+		select {
+		case <-done:
+			return false
+		default:
+		}
+		if !sleepUnlessDone(align+jitter, done) {
+			return false
+		}
+		// Drift is how late the scheduler was, so it is measured before
+		// waiting for a slot or group, and only for the run dispatched
+		// for the scheduled time, not runs queued behind it.
+		if !scheduled.IsZero() {
+			scheduleDriftGauge.WithLabelValues(j.Name).Set(clock.Now().Sub(scheduled).Seconds())
+			scheduled = time.Time{}
+		}
+		if !acquireGroup(j, done) {
+			return false
+		}
+		if !acquireJobSlot(j.Name, done) {
+			releaseGroup(j)
+			return false
+		}
+		logEvent("info", "job_start", logFields{"job": j.Name}, "starting job %s", j.Name)
+		runningGauge.WithLabelValues(j.Name).Inc()
+		runningJobsGauge.Inc()
+		if j.Heartbeat != "" {
+			heartbeatStarted = sendHeartbeat(j.Name, heartbeatURL(j.Heartbeat, "start", 0), nil)
+		}
+		return true
+	}, func(jobName string, attempt int, backoff time.Duration, err error) bool {
+		logEvent("warn", "job_retry", logFields{"job": jobName, "attempt": attempt, "backoff": backoff.Seconds()},
+			"job %s attempt %d failed, retrying in %s: %s", jobName, attempt, backoff, err)
+		retryCounter.WithLabelValues(jobName).Inc()
+		return sleepUnlessDone(backoff, done)
+	}, func(jobName string, duration time.Duration, cmd *exec.Cmd, err error) {
+		onJobExit(jobName, duration, cmd, err)
+		releaseGroup(j)
+		if j.MaxDuration != 0 && duration > j.MaxDuration {
+			logEvent("warn", "job_slow", logFields{"job": jobName, "duration": duration.Seconds(), "max_duration": j.MaxDuration.Seconds()},
+				"job %s took %s, longer than its maximum of %s", jobName, duration, j.MaxDuration)
+			slowCounter.WithLabelValues(jobName).Inc()
+		}
+		if err == nil && j.OnSuccess != "" {
+			runJobHook(j, "@on-success", j.OnSuccess, 0)
+		} else if err != nil && j.OnFailure != "" {
+			runJobHook(j, "@on-failure", j.OnFailure, jobExitStatus(err))
+		}
+		if j.Heartbeat != "" {
+			event := "success"
+			if err != nil {
+				event = "fail"
 			}
+			sendHeartbeat(jobName, heartbeatURL(j.Heartbeat, event, jobExitStatus(err)), heartbeatStarted)
 		}
-	} else {
-		exitStatus = 0
+	})
+}
+
+// listenMetrics listens on the -prometheus-metrics address, which is
+// either address:port or unix:PATH for a unix socket. A stale socket
+// left at PATH is replaced, and the socket is removed when the listener
+// is closed.
+func listenMetrics(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		scheme := "http"
+		if *tlsCert != "" {
+			scheme = "https"
+		}
+		l, err := net.Listen("tcp", addr)
+		if err == nil {
+			log.Printf("serving prometheus metrics at %s://%s/metrics", scheme, addr)
+		}
+		return l, err
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+	if st, err := os.Lstat(path); err == nil && st.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err == nil {
+		log.Printf("serving prometheus metrics on unix socket %s", path)
+	}
+	return l, err
+}
+
+// requireAuth wraps h to require the -metrics-auth credentials,
+// if they were given, using HTTP basic auth.
+func requireAuth(h http.Handler) http.Handler {
+	if *metricsAuth == "" {
+		return h
+	}
+	i := strings.IndexByte(*metricsAuth, ':')
+	wantUser, wantPassword := []byte((*metricsAuth)[:i]), []byte((*metricsAuth)[i+1:])
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		// Both are always compared, so the time taken doesn't
+		// reveal which was wrong.
+		userOk := subtle.ConstantTimeCompare([]byte(user), wantUser) == 1
+		passwordOk := subtle.ConstantTimeCompare([]byte(password), wantPassword) == 1
+		if !ok || !userOk || !passwordOk {
+			w.Header().Set("WWW-Authenticate", `Basic realm="promcron"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestReload asks the scheduler to reload the table, unless a
+// reload is already pending.
+func requestReload() {
+	select {
+	case reloadRequests <- struct{}{}:
+	default:
+	}
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&schedulerRunning) == 0 {
+		http.Error(w, "not running", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST to reload", http.StatusMethodNotAllowed)
+		return
+	}
+	requestReload()
+	fmt.Fprintln(w, "reload requested")
+}
+
+func onJobExit(jobName string, duration time.Duration, cmd *exec.Cmd, err error) {
+	if *pushgateway != "" {
+		// Deferred so the job's metrics are up to date.
+		defer pushJobMetrics(*pushgateway, *pushgatewayInstance, jobName)
+	}
+	if *textfile != "" {
+		defer func() {
+			err := writeTextfile(*textfile)
+			if err != nil {
+				log.Printf("error writing metrics to %q: %s", *textfile, err)
+			}
+		}()
 	}
 
-	log.Printf("job %s finished in %s with exit status %d", jobName, duration, exitStatus)
+	exitStatus := jobExitStatus(err)
+	recordExitStatus(jobName, exitStatus)
+
+	var timeout *TimeoutError
+	if errors.As(err, &timeout) {
+		logEvent("warn", "job_timeout", logFields{"job": jobName, "timeout": timeout.Timeout.Seconds()},
+			"job %s killed after its timeout of %s", jobName, timeout.Timeout)
+		timeoutCounter.WithLabelValues(jobName).Inc()
+	}
+	if cmd.ProcessState == nil {
+		logEvent("error", "job_start_error", logFields{"job": jobName, "error": err.Error()}, "job %s failed to start: %s", jobName, err)
+		startErrorCounter.WithLabelValues(jobName).Inc()
+	}
+
+	level := "info"
+	if exitStatus != 0 {
+		level = "warn"
+	}
+	logEvent(level, "job_finish", logFields{"job": jobName, "duration": duration.Seconds(), "exit_code": exitStatus},
+		"job %s finished in %s with exit status %d", jobName, duration, exitStatus)
 
-	runningGauge.WithLabelValues(jobName).Set(0)
+	runningGauge.WithLabelValues(jobName).Dec()
+	runningJobsGauge.Dec()
+	releaseJobSlot()
 
+	endTime := time.Now()
+	record := &runRecord{
+		Job:      jobName,
+		Start:    endTime.Add(-duration),
+		End:      endTime,
+		Duration: duration.Seconds(),
+		ExitCode: exitStatus,
+	}
+	if runLog != nil {
+		// Deferred so the resource usage is filled in.
+		defer writeRunLog(record)
+	}
+	lastRunGauge.WithLabelValues(jobName).Set(float64(endTime.Unix()))
 	if exitStatus == 0 {
 		successCounter.WithLabelValues(jobName).Inc()
+		lastSuccessGauge.WithLabelValues(jobName).Set(float64(endTime.Unix()))
+		consecutiveFailuresGauge.WithLabelValues(jobName).Set(0)
 	} else {
 		failureCounter.WithLabelValues(jobName).Inc()
+		consecutiveFailuresGauge.WithLabelValues(jobName).Inc()
+	}
+
+	if state != nil {
+		state.RecordExit(jobName, endTime, exitStatus == 0)
+		err := state.Save()
+		if err != nil {
+			log.Printf("error saving state: %s", err)
+		}
 	}
 
 	durationGauge.WithLabelValues(jobName).Set(duration.Seconds())
 
-	if rusage, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
-		durationGauge.WithLabelValues(jobName).Set(duration.Seconds())
-		maxrssBytesGauge.WithLabelValues(jobName).Set(float64(rusage.Maxrss * 1024))
-		utimeGauge.WithLabelValues(jobName).Set(float64(rusage.Utime.Sec) + (float64(rusage.Utime.Usec) / 1000000.0))
-		stimeGauge.WithLabelValues(jobName).Set(float64(rusage.Stime.Sec) + (float64(rusage.Stime.Usec) / 1000000.0))
+	var rusage *syscall.Rusage
+	if cmd.ProcessState != nil {
+		rusage, _ = cmd.ProcessState.SysUsage().(*syscall.Rusage)
+		if rusage == nil {
+			rusageWarning.Do(func() {
+				log.Printf("resource usage of jobs is not supported on this platform")
+			})
+		}
+	}
+	if rusage == nil {
+		// Don't leave the previous run's usage looking like this one's.
+		maxrssBytesGauge.WithLabelValues(jobName).Set(math.NaN())
+		utimeGauge.WithLabelValues(jobName).Set(math.NaN())
+		stimeGauge.WithLabelValues(jobName).Set(math.NaN())
+		return
+	}
+	record.MaxrssBytes = int64(rusage.Maxrss) * maxrssUnit
+	record.UtimeSeconds = float64(rusage.Utime.Sec) + (float64(rusage.Utime.Usec) / 1000000.0)
+	record.StimeSeconds = float64(rusage.Stime.Sec) + (float64(rusage.Stime.Usec) / 1000000.0)
+	maxrssBytesGauge.WithLabelValues(jobName).Set(float64(record.MaxrssBytes))
+	utimeGauge.WithLabelValues(jobName).Set(record.UtimeSeconds)
+	stimeGauge.WithLabelValues(jobName).Set(record.StimeSeconds)
+}
+
+// rusageWarning logs once that resource usage is unsupported.
+var rusageWarning sync.Once
+
+// runHook runs a shell command with extra environment variables,
+// passing its output through and logging if it fails. Hooks are
+// not jobs, so they never cause other hooks to run.
+func runHook(what, command string, env []string) {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		log.Printf("%s failed: %s", what, err)
+	}
+}
+
+// recordTimeJump logs and counts a time anomaly of the given size,
+// running the -time-jump-command in the background if it is large enough.
+func recordTimeJump(jump time.Duration) {
+	timeJumpGauge.Set(jump.Seconds())
+	if *timeJumpCommand != "" && (jump >= *timeJumpThreshold || -jump >= *timeJumpThreshold) {
+		go runTimeJumpCommand(*timeJumpCommand, jump)
+	}
+	if jump > 0 {
+		logEvent("warn", "time_jump", logFields{"direction": "forward"}, "forward time jump detected, jobs may have been skipped")
+		forwardTimeSkips.Inc()
+	} else {
+		logEvent("warn", "time_jump", logFields{"direction": "backward"}, "backward time jump detected, jobs may be run multiple times")
+		backwardTimeSkips.Inc()
+	}
+}
+
+// runTimeJumpCommand runs the -time-jump-command, telling it the size
+// of the jump in seconds through $PROMCRON_TIME_JUMP_SECONDS.
+func runTimeJumpCommand(command string, jump time.Duration) {
+	runHook("time jump command", command, []string{
+		fmt.Sprintf("PROMCRON_TIME_JUMP_SECONDS=%d", int64(jump.Seconds())),
+	})
+}
+
+// runJobHook runs a job's @on-success or @on-failure command in the
+// background, with the job's environment and its name and exit status
+// in $PROMCRON_JOB and $PROMCRON_EXIT_CODE.
+func runJobHook(j *Job, what, command string, exitStatus int) {
+	env := append(append([]string{}, j.Env...),
+		"PROMCRON_JOB="+j.Name,
+		fmt.Sprintf("PROMCRON_EXIT_CODE=%d", exitStatus),
+	)
+	go runHook(fmt.Sprintf("%s hook of job %s", what, j.Name), command, env)
+}
+
+// jobExitStatus returns the exit status of a job that returned err,
+// or 127 if it couldn't be run.
+func jobExitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exiterr *exec.ExitError
+	if errors.As(err, &exiterr) {
+		if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return 127
+}
+
+// missedRuns counts how many times each job was due at the checks
+// strictly between from and to, up to max times per job.
+func missedRuns(jobs []*Job, from, to time.Time, max int) map[*Job]int {
+	missed := make(map[*Job]int)
+	capped := 0
+	for t := from.Add(delayTillNextCheck(from)); t.Before(to) && capped < len(jobs); t = t.Add(delayTillNextCheck(t)) {
+		for _, j := range jobs {
+			due := dueTime(t)
+			if missed[j] == max || !jobDue(j, &due) {
+				continue
+			}
+			missed[j]++
+			if missed[j] == max {
+				capped++
+			}
+		}
+	}
+	return missed
+}
+
+// runAndExit runs the named job once, printing its output, then
+// exits with its exit status.
+func runAndExit(jobs []*Job, name string) {
+	var job *Job
+	names := make([]string, 0, len(jobs))
+	for _, j := range jobs {
+		names = append(names, j.Name)
+		if j.Name == name {
+			job = j
+		}
 	}
+	if job == nil {
+		sort.Strings(names)
+		log.Fatalf("no job named %q, the jobs are: %s", name, strings.Join(names, ", "))
+	}
+	job.LogFile = ""
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	os.Exit(runJobOnce(job, sigs))
+}
 
+// runJobOnce runs job once, returning its exit status. The job runs in
+// its own process group, so Ctrl-C in the terminal only reaches promcron,
+// and signals received on sigs are passed on to the job's process group.
+// After the first, retries are given up.
+func runJobOnce(job *Job, sigs <-chan os.Signal) int {
+	interrupted := make(chan struct{})
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		interrupt := interrupted
+		for {
+			select {
+			case sig := <-sigs:
+				if interrupt != nil {
+					close(interrupt)
+					interrupt = nil
+				}
+				err := job.Signal(sig)
+				if err != nil {
+					log.Printf("error passing %s on to job %s: %s", sig, job.Name, err)
+				}
+			case <-finished:
+				return
+			}
+		}
+	}()
+	exitStatus := 0
+	job.StartWhen(func() bool {
+		return true
+	}, func(jobName string, attempt int, backoff time.Duration, err error) bool {
+		return sleepUnlessDone(backoff, interrupted)
+	}, func(jobName string, duration time.Duration, cmd *exec.Cmd, err error) {
+		exitStatus = jobExitStatus(err)
+		if cmd.ProcessState == nil {
+			log.Printf("job %s failed to start: %s", jobName, err)
+		}
+	})
+	job.Wait()
+	return exitStatus
+}
+
+// checkCommands checks the shell syntax of each job's command, or that
+// the program of an @exec job exists, without running it, logging and
+// counting the jobs that fail.
+func checkCommands(jobs []*Job) int {
+	failed := 0
+	for _, j := range jobs {
+		if j.Exec {
+			_, err := exec.LookPath(j.Args[0])
+			if err != nil {
+				failed++
+				log.Printf("job %s has an invalid command: %s", j.Name, err)
+			}
+			continue
+		}
+		out, err := exec.Command("/bin/sh", "-n", "-c", j.Command).CombinedOutput()
+		if err != nil {
+			failed++
+			msg := strings.TrimSpace(string(out))
+			if msg == "" {
+				msg = err.Error()
+			}
+			log.Printf("job %s has an invalid command: %s", j.Name, msg)
+		}
+	}
+	return failed
+}
+
+func checkAndExit(jobs []*Job) {
+	writeCheckReport(os.Stdout, jobs)
+	os.Exit(0)
+}
+
+// writeCheckReport lists the jobs of tables that passed -check.
+func writeCheckReport(w io.Writer, jobs []*Job) {
+	for _, j := range jobs {
+		fmt.Fprintf(w, "%s - %s\n", j.Name, j.Command)
+	}
+	fmt.Fprintf(w, "%s: %d jobs ok\n", tabNames(), len(jobs))
+}
+
+// killDelay is how long terminated jobs have to exit before being killed,
+// and killed jobs before promcron stops waiting for them.
+var killDelay = 5 * time.Second
+
+// shutdownMetricsServer stops srv accepting connections and waits for
+// requests in progress to finish, for at most grace unless it is zero.
+func shutdownMetricsServer(srv *http.Server, grace time.Duration) error {
+	ctx := context.Background()
+	if grace != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, grace)
+		defer cancel()
+	}
+	return srv.Shutdown(ctx)
+}
+
+// forwardSignal passes sig on to the jobs that are running.
+func forwardSignal(jobs []*Job, sig os.Signal) {
+	for _, j := range jobs {
+		if !j.IsRunning() {
+			continue
+		}
+		log.Printf("forwarding %s to job %s", sig, j.Name)
+		err := j.Signal(sig)
+		if err != nil {
+			log.Printf("error signalling job %s: %s", j.Name, err)
+		}
+	}
+}
+
+// waitForJobs waits for running jobs to finish. After grace, if it isn't
+// zero, the remaining jobs are sent SIGTERM, then SIGKILL after killDelay,
+// and it gives up waiting killDelay after that. It returns false if any
+// jobs had to be terminated.
+func waitForJobs(jobs []*Job, grace time.Duration) bool {
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		if !j.IsRunning() {
+			continue
+		}
+		log.Printf("waiting for job %s", j.Name)
+		wg.Add(1)
+		go func(j *Job) {
+			defer wg.Done()
+			j.Wait()
+			log.Printf("job %s finished", j.Name)
+		}(j)
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	if grace == 0 {
+		<-finished
+		return true
+	}
+
+	select {
+	case <-finished:
+		return true
+	case <-time.After(grace):
+	}
+	for _, sig := range []struct {
+		name string
+		sig  syscall.Signal
+	}{{"SIGTERM", syscall.SIGTERM}, {"SIGKILL", syscall.SIGKILL}} {
+		for _, j := range jobs {
+			if j.IsRunning() {
+				log.Printf("sending %s to job %s", sig.name, j.Name)
+				err := j.Signal(sig.sig)
+				if err != nil {
+					log.Printf("error signalling job %s: %s", j.Name, err)
+				}
+			}
+		}
+		select {
+		case <-finished:
+			return false
+		case <-time.After(killDelay):
+		}
+	}
+	for _, j := range jobs {
+		if j.IsRunning() {
+			log.Printf("giving up waiting for job %s after SIGKILL", j.Name)
+		}
+	}
+	return false
+}
+
+func printNextAndExit(jobs []*Job) {
+	writeNextRuns(os.Stdout, jobs, time.Now())
+	os.Exit(0)
+}
+
+// writeNextRuns writes the first run of each job after from, within
+// -next-horizon.
+func writeNextRuns(w io.Writer, jobs []*Job, from time.Time) {
+	tfmt := "2006/01/02 15:04"
+	if tickInterval != time.Minute {
+		tfmt = "2006/01/02 15:04:05"
+	}
+	// Jobs that never run on a schedule would otherwise be
+	// checked at every tick of the horizon.
+	scheduled := []*Job{}
+	for _, j := range jobs {
+		if !j.Disabled && !j.KeepAlive && j.Interval == 0 {
+			scheduled = append(scheduled, j)
+		}
+	}
+	next := make(map[*Job]time.Time)
+	simulatedTime := from
+	end := simulatedTime.Add(*nextHorizon)
+	for end.After(simulatedTime) && len(next) != len(scheduled) {
+		simulatedTime = simulatedTime.Add(delayTillNextCheck(simulatedTime))
+		due := dueTime(simulatedTime)
+		for _, j := range scheduled {
+			if _, ok := next[j]; ok || !jobDue(j, &due) {
+				continue
+			}
+			next[j] = due
+		}
+	}
+	sorted := append([]*Job{}, jobs...)
+	sort.Slice(sorted, func(i, k int) bool { return sorted[i].Name < sorted[k].Name })
+	for _, j := range sorted {
+		if t, ok := next[j]; ok {
+			fmt.Fprintf(w, "%s - %s\n", j.Name, t.Format(tfmt))
+		} else if j.Disabled {
+			fmt.Fprintf(w, "%s - disabled\n", j.Name)
+		} else if j.KeepAlive {
+			fmt.Fprintf(w, "%s - kept alive\n", j.Name)
+		} else if j.Interval != 0 {
+			fmt.Fprintf(w, "%s - every %s\n", j.Name, j.Interval)
+		} else {
+			fmt.Fprintf(w, "%s - none within %s\n", j.Name, *nextHorizon)
+		}
+	}
 }
 
 func printScheduleAndExit(jobs []*Job) {
@@ -138,122 +1078,445 @@ func printScheduleAndExit(jobs []*Job) {
 	if *printScheduleFor != 0 {
 		duration = *printScheduleFor
 	}
-	simulatedTime := time.Now()
+	err := writeSchedule(os.Stdout, jobs, time.Now(), duration)
+	if err != nil {
+		log.Fatalf("error printing schedule: %s", err)
+	}
+	os.Exit(0)
+}
+
+// writeSchedule writes the runs due in the duration after from, as JSON
+// with -print-schedule-json.
+func writeSchedule(w io.Writer, jobs []*Job, from time.Time, duration time.Duration) error {
+	tfmt := "2006/01/02 15:04"
+	if tickInterval != time.Minute {
+		tfmt = "2006/01/02 15:04:05"
+	}
+	type scheduledRun struct {
+		Time        string `json:"time"`
+		Job         string `json:"job"`
+		Description string `json:"description,omitempty"`
+	}
+	runs := []scheduledRun{}
+	simulatedTime := from
 	end := simulatedTime.Add(duration)
 	for end.After(simulatedTime) {
 		simulatedTime = simulatedTime.Add(delayTillNextCheck(simulatedTime))
+		due := dueTime(simulatedTime)
 		for _, j := range jobs {
-			if !j.ShouldRunAt(&simulatedTime) {
+			if !jobDue(j, &due) {
+				continue
+			}
+			if *printScheduleJSON {
+				runs = append(runs, scheduledRun{
+					Time:        due.Truncate(tickInterval).Format(time.RFC3339),
+					Job:         j.Name,
+					Description: j.Description,
+				})
+				continue
+			}
+			if j.Description != "" {
+				fmt.Fprintf(w, "%s - %s - %s\n", due.Format(tfmt), j.Name, j.Description)
 				continue
 			}
-			fmt.Printf("%s - %s\n", simulatedTime.Format("2006/01/02 15:04"), j.Name)
+			fmt.Fprintf(w, "%s - %s\n", due.Format(tfmt), j.Name)
 		}
 	}
-	os.Exit(0)
+	if !*printScheduleJSON {
+		return nil
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(runs)
 }
 
 func main() {
 	flag.Parse()
+	if len(tabs) == 0 && *tabDir == "" {
+		tabs = tabFiles{"/etc/promcron"}
+	}
 
-	tabData, err := ioutil.ReadFile(*tab)
-	if err != nil {
-		log.Fatalf("error reading %q: %s", *tab, err)
+	rand.Seed(time.Now().UnixNano())
+
+	if *printVersion {
+		fmt.Println(versionString())
+		os.Exit(0)
 	}
 
-	jobs, err := ParseJobs(*tab, string(tabData))
+	err := setLogFormat(*logFormat)
 	if err != nil {
 		log.Fatalf("%s", err)
 	}
 
-	if *printSchedule || *printScheduleFor != 0 {
+	if *explain != "" {
+		description, err := ExplainSchedule(*explain, *seconds, *dayAnd)
+		if err != nil {
+			log.Fatalf("invalid timespec %q: %s", *explain, err)
+		}
+		fmt.Println(description)
+		os.Exit(0)
+	}
+
+	jobs, err := loadJobs()
+	if err != nil {
+		log.Fatalf("error loading %q: %s", tabNames(), err)
+	}
+
+	tickInterval = jobTickInterval(jobs)
+
+	if *checkCmds {
+		failed := checkCommands(jobs)
+		if failed != 0 {
+			log.Fatalf("%d jobs have invalid commands", failed)
+		}
+	}
+
+	if *check {
+		checkAndExit(jobs)
+	}
+
+	if *runJob != "" {
+		runAndExit(jobs, *runJob)
+	}
+
+	if *printNext {
+		printNextAndExit(jobs)
+	}
+
+	if *dumpParsed {
+		for _, j := range jobs {
+			fmt.Print(DumpParsed(j))
+		}
+		os.Exit(0)
+	}
+
+	if *printSchedule || *printScheduleFor != 0 || *printScheduleJSON {
 		printScheduleAndExit(jobs)
 	}
 
+	if *concurrencyPolicy != "queue" && *concurrencyPolicy != "skip" {
+		log.Fatalf("unknown -concurrency-policy %q, expected 'queue' or 'skip'", *concurrencyPolicy)
+	}
+	if *groupPolicy != "queue" && *groupPolicy != "skip" {
+		log.Fatalf("unknown -group-policy %q, expected 'queue' or 'skip'", *groupPolicy)
+	}
+	if *maxConcurrent > 0 {
+		jobSlots = make(chan struct{}, *maxConcurrent)
+	}
+
+	if *pushgateway != "" && *pushgatewayInstance == "" {
+		*pushgatewayInstance, err = os.Hostname()
+		if err != nil {
+			log.Fatalf("error getting hostname for -pushgateway-instance: %s", err)
+		}
+	}
+
+	if *catchup && *stateFile == "" {
+		log.Fatalf("-catchup requires a -state-file")
+	}
+	if *stateFile != "" {
+		state, err = LoadState(*stateFile)
+		if err != nil {
+			log.Printf("ignoring unusable state file %q: %s", *stateFile, err)
+		}
+	}
+
+	startTimeGauge.SetToCurrentTime()
+	setCurrentJobs(jobs)
+	jobsConfiguredGauge.Set(float64(len(jobs)))
+
 	// Init prometheus vectors with job names.
 	for _, j := range jobs {
-		overdueCounter.WithLabelValues(j.Name)
-		failureCounter.WithLabelValues(j.Name)
-		successCounter.WithLabelValues(j.Name)
-		durationGauge.WithLabelValues(j.Name)
-		maxrssBytesGauge.WithLabelValues(j.Name)
-		utimeGauge.WithLabelValues(j.Name)
-		stimeGauge.WithLabelValues(j.Name)
-		runningGauge.WithLabelValues(j.Name)
+		initJobMetrics(j.Name)
+		setJobEnabled(j)
+	}
+
+	if *runLogPath != "" {
+		err := openRunLog(*runLogPath)
+		if err != nil {
+			log.Fatalf("error opening run log %q: %s", *runLogPath, err)
+		}
+	}
+
+	if *textfile != "" {
+		err := writeTextfile(*textfile)
+		if err != nil {
+			log.Fatalf("error writing metrics to %q: %s", *textfile, err)
+		}
 	}
 
+	var metricsServer *http.Server
 	if *metricsAddress != "" {
-		go func() {
-			http.Handle("/metrics", promhttp.Handler())
-			log.Printf("serving prometheus metrics at http://%s/metrics", *metricsAddress)
-			err := http.ListenAndServe(*metricsAddress, nil)
+		if (*tlsCert == "") != (*tlsKey == "") {
+			log.Fatalf("-tls-cert and -tls-key must be given together")
+		}
+		if *metricsAuth != "" && !strings.Contains(*metricsAuth, ":") {
+			log.Fatalf("-metrics-auth must be of the form user:password")
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", requireAuth(promhttp.Handler()))
+		mux.HandleFunc("/healthz", healthHandler)
+		mux.HandleFunc("/ready", healthHandler)
+		mux.Handle("/-/reload", requireAuth(http.HandlerFunc(reloadHandler)))
+		mux.Handle("/jobs", requireAuth(http.HandlerFunc(jobsHandler)))
+		metricsServer = &http.Server{Addr: *metricsAddress, Handler: mux}
+		// Everything that can fail is done before the scheduler starts,
+		// so a taken port or a bad certificate stops promcron straight away.
+		if *tlsCert != "" {
+			cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
 			if err != nil {
+				log.Fatalf("error loading -tls-cert and -tls-key: %s", err)
+			}
+			metricsServer.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		l, err := listenMetrics(*metricsAddress)
+		if err != nil {
+			log.Fatalf("error listening on -prometheus-metrics address %q: %s", *metricsAddress, err)
+		}
+		go func() {
+			var err error
+			if *tlsCert != "" {
+				err = metricsServer.ServeTLS(l, "", "")
+			} else {
+				err = metricsServer.Serve(l)
+			}
+			if err != nil && err != http.ErrServerClosed {
 				log.Fatalf("error running metrics server: %s", err)
 			}
 		}()
 	}
 
 	done := make(chan struct{}, 1)
+	// shutdownSignal is the signal that closed done.
+	var shutdownSignal os.Signal
 
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
 	go func() {
-		<-sigs
-		log.Printf("shutting down due to signal")
-		close(done)
-		<-sigs
-		log.Fatalf("forcing shutdown due to signal")
+		for sig := range sigs {
+			switch sig {
+			case syscall.SIGHUP:
+				requestReload()
+				continue
+			case syscall.SIGUSR1:
+				logStatus()
+				continue
+			}
+			if shutdownSignal != nil {
+				log.Fatalf("forcing shutdown due to signal")
+			}
+			log.Printf("shutting down due to signal")
+			shutdownSignal = sig
+			close(done)
+		}
 	}()
 
+	configReloadSuccessGauge.Set(1)
+	if *watch {
+		go watchTabs(done)
+	}
+
 	log.Printf("scheduling %d jobs", len(jobs))
+	if *dryRun {
+		log.Printf("dry run: no jobs will be run")
+	}
 
-	now := time.Now()
+	jobs = schedule(jobs, done)
+
+	if *forwardSignals {
+		forwardSignal(jobs, shutdownSignal)
+	}
+
+	clean := waitForJobs(jobs, *shutdownGrace)
+
+	if state != nil && !*dryRun {
+		err := state.Save()
+		if err != nil {
+			log.Printf("error saving state: %s", err)
+		}
+	}
+
+	// The metrics server is shut down last, so the final
+	// job metrics can still be scraped while jobs finish.
+	if metricsServer != nil {
+		err := shutdownMetricsServer(metricsServer, *shutdownGrace)
+		if err != nil {
+			log.Printf("error shutting down metrics server: %s", err)
+		}
+	}
+
+	if !clean {
+		log.Fatalf("jobs were still running after the %s shutdown grace period", *shutdownGrace)
+	}
+	if *failIfUnhealthy && !*dryRun {
+		if names := unhealthyJobs(); len(names) != 0 {
+			log.Fatalf("jobs failing or never succeeded at shutdown: %s", strings.Join(names, ", "))
+		}
+	}
+}
+
+// readyToDispatch decides whether a due job should start now, logging
+// and counting why not. A job still running, including a retired job of
+// the same name, is overdue and handled according to its @overlap, and
+// @requires and flag files can skip it.
+func readyToDispatch(j *Job, retired []*Job) bool {
+	if j.IsRunning() || retiredRunning(retired, j.Name) {
+		if runningFor(j, retired) >= j.OverdueAfter {
+			logEvent("warn", "job_overdue", logFields{"job": j.Name}, "job %s is overdue", j.Name)
+			overdueCounter.WithLabelValues(j.Name).Inc()
+		}
+		switch j.Overlap {
+		case OverlapQueue:
+			if j.QueueRun() {
+				logEvent("info", "job_queue", logFields{"job": j.Name}, "queueing job %s until its current run finishes", j.Name)
+				return false
+			}
+			// It finished in the meantime, so start it as usual.
+		case OverlapParallel:
+		default:
+			return false
+		}
+	}
+	if j.Requires != "" && !lastSucceeded(j.Requires) {
+		logEvent("warn", "job_skip", logFields{"job": j.Name, "requires": j.Requires}, "skipping job %s, the last run of %s did not succeed", j.Name, j.Requires)
+		skippedDependencyCounter.WithLabelValues(j.Name).Inc()
+		return false
+	}
+	if reason := flagFileSkip(j); reason != "" {
+		logEvent("info", "job_skip", logFields{"job": j.Name}, "skipping job %s, %s", j.Name, reason)
+		skippedFlagFileCounter.WithLabelValues(j.Name).Inc()
+		return false
+	}
+	return true
+}
+
+// schedule runs the scheduler loop, starting jobs as they become due
+// until done is closed, then returns every job that may still be
+// running, including those replaced by reloads.
+func schedule(jobs []*Job, done <-chan struct{}) []*Job {
+	now := clock.Now()
 	delay := delayTillNextCheck(now)
-	prevCheck := now.Add(delay).Add(-60 * time.Second)
+	prevCheck := now.Add(delay).Add(-tickInterval)
+
+	catchupRuns := make(map[*Job]int)
+	if *catchup && !state.LastCheck.IsZero() {
+		catchupRuns = missedRuns(jobs, state.LastCheck, prevCheck, *catchupMax)
+		for j, n := range catchupRuns {
+			log.Printf("job %s missed %d runs since %s", j.Name, n, state.LastCheck.Format("2006/01/02 15:04:05"))
+		}
+	}
+
+	// retired holds jobs from before a reload that are still running.
+	var retired []*Job
+
+	atomic.StoreInt32(&schedulerRunning, 1)
+	superviseJobs(jobs, done)
+	runIntervals(jobs, done)
 
 scheduler:
 	for {
-		now = time.Now()
+		now = clock.Now()
 		delay = delayTillNextCheck(now)
 		nextCheck := now.Add(delay)
-		actualPrevCheck := nextCheck.Add(-60 * time.Second)
+		actualPrevCheck := nextCheck.Add(-tickInterval)
 
 		if actualPrevCheck.Unix() != prevCheck.Unix() {
-			if actualPrevCheck.After(prevCheck) {
-				log.Printf("forward time jump detected, jobs may have been skipped")
-				forwardTimeSkips.Inc()
-			} else {
-				log.Printf("backward time jump detected, jobs may be run multiple times")
-				backwardTimeSkips.Inc()
-			}
+			recordTimeJump(actualPrevCheck.Sub(prevCheck))
 		}
 
 		select {
-		case <-time.After(delay):
+		case <-clock.After(delay):
 		case <-done:
 			break scheduler
+		case <-reloadRequests:
+			newJobs, err := loadJobs()
+			configReloadsCounter.Inc()
+			if err != nil {
+				log.Printf("error reloading %q, keeping the current jobs: %s", tabNames(), err)
+				configReloadSuccessGauge.Set(0)
+				continue scheduler
+			}
+			configReloadSuccessGauge.Set(1)
+			retired = replaceJobs(jobs, retired, newJobs)
+			byName := make(map[string]*Job)
+			for _, j := range newJobs {
+				byName[j.Name] = j
+			}
+			for j, n := range catchupRuns {
+				delete(catchupRuns, j)
+				if newJob, ok := byName[j.Name]; ok {
+					catchupRuns[newJob] = n
+				}
+			}
+			jobs = newJobs
+			superviseJobs(jobs, done)
+			runIntervals(jobs, done)
+			setCurrentJobs(jobs)
+			jobsConfiguredGauge.Set(float64(len(jobs)))
+			tickInterval = jobTickInterval(jobs)
+			now = clock.Now()
+			prevCheck = now.Add(delayTillNextCheck(now)).Add(-tickInterval)
+			log.Printf("reloaded %q, scheduling %d jobs", tabNames(), len(jobs))
+			continue scheduler
+		}
+
+		tickStart := clock.Now()
+		lastTickGauge.Set(float64(tickStart.UnixNano()) / 1e9)
+		retired = pruneRetired(jobs, retired)
+		for _, j := range jobs {
+			runningSecondsGauge.WithLabelValues(j.Name).Set(runningFor(j, retired).Seconds())
 		}
 
+		// With -align-starts, look ahead to the jobs due at the start of
+		// the next tick, and hold them until then.
+		due := actualPrevCheck
+		var align time.Duration
+		if *alignStarts {
+			due = dueTime(nextCheck.Add(tickInterval))
+			align = due.Sub(clock.Now()) - *startLead
+		}
 		for _, j := range jobs {
-			if !j.ShouldRunAt(&now) {
+			if !jobDue(j, &due) || !readyToDispatch(j, retired) {
 				continue
 			}
-			if j.IsRunning() {
-				log.Printf("job %s is overdue", j.Name)
-				overdueCounter.WithLabelValues(j.Name).Inc()
+			// Dispatching never blocks, jitter, the -max-concurrent
+			// limit and starting the command all happen in the job's
+			// own goroutine, so jobs due together start together.
+			// Never delay a job past the next check.
+			jitter := chooseJitter(j, nextCheck.Add(tickInterval).Sub(clock.Now())-align)
+			jitterGauge.WithLabelValues(j.Name).Set(jitter.Seconds())
+			dispatchJob(j, scheduledTime(j, due), align, jitter, done)
+		}
+
+		// Catch up on missed runs one at a time, whenever
+		// the job isn't busy with a scheduled run.
+		for j, n := range catchupRuns {
+			if j.IsRunning() || retiredRunning(retired, j.Name) {
 				continue
 			}
-			log.Printf("starting job %s", j.Name)
-			runningGauge.WithLabelValues(j.Name).Set(1)
-			j.Start(onJobExit)
+			logEvent("info", "job_catchup", logFields{"job": j.Name}, "catching up on job %s", j.Name)
+			dispatchJob(j, time.Time{}, 0, 0, done)
+			if n == 1 {
+				delete(catchupRuns, j)
+			} else {
+				catchupRuns[j] = n - 1
+			}
+		}
+		tickDurationHistogram.Observe(clock.Now().Sub(tickStart).Seconds())
+
+		if state != nil && !*dryRun {
+			state.SetLastCheck(actualPrevCheck)
+			err := state.Save()
+			if err != nil {
+				log.Printf("error saving state: %s", err)
+			}
 		}
 
 		prevCheck = nextCheck
 	}
 
-	for _, j := range jobs {
-		if j.IsRunning() {
-			log.Printf("waiting for job %s", j.Name)
-			j.Wait()
-		}
-	}
+	atomic.StoreInt32(&schedulerRunning, 0)
+	superviseJobs(nil, done)
+	runIntervals(nil, done)
+	return append(jobs, retired...)
 }
@@ -0,0 +1,1050 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMissedRuns(t *testing.T) {
+	jobs, err := ParseJobs("test", "hourly 0 * * * * true\nminutely * * * * * true\nnever 0 0 1 jan * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2021, 6, 1, 10, 0, 30, 0, time.UTC)
+	to := time.Date(2021, 6, 1, 12, 30, 30, 0, time.UTC)
+	missed := missedRuns(jobs, from, to, 3)
+	if missed[jobs[0]] != 2 {
+		t.Fatalf("expected 2 missed hourly runs, got %d", missed[jobs[0]])
+	}
+	if missed[jobs[1]] != 3 {
+		t.Fatalf("expected 3 missed minutely runs, got %d", missed[jobs[1]])
+	}
+	if missed[jobs[2]] != 0 {
+		t.Fatalf("expected no missed runs, got %d", missed[jobs[2]])
+	}
+}
+
+func TestDelayTillNextCheck(t *testing.T) {
+	defer func(offset, lead time.Duration) {
+		*tickOffset = offset
+		*startLead = lead
+	}(*tickOffset, *startLead)
+	for _, tc := range []struct {
+		offset   time.Duration
+		lead     time.Duration
+		from     time.Duration
+		expected time.Duration
+	}{
+		{30 * time.Second, 0, 10 * time.Second, 80 * time.Second},
+		{30 * time.Second, 0, 30 * time.Second, 60 * time.Second},
+		{10 * time.Second, 0, 5*time.Second + 500*time.Millisecond, 64*time.Second + 500*time.Millisecond},
+		{10 * time.Second, 0, 20 * time.Second, 50 * time.Second},
+		{-5 * time.Second, 0, 20 * time.Second, 40 * time.Second},
+		{90 * time.Second, 0, 20 * time.Second, 100*time.Second - 1},
+		{30 * time.Second, 2 * time.Second, 10 * time.Second, 78 * time.Second},
+		{30 * time.Second, 2 * time.Second, 28 * time.Second, 60 * time.Second},
+		{10 * time.Second, time.Minute, 20 * time.Second, 40 * time.Second},
+		{30 * time.Second, -time.Second, 10 * time.Second, 80 * time.Second},
+	} {
+		*tickOffset = tc.offset
+		*startLead = tc.lead
+		from := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC).Add(tc.from)
+		if d := delayTillNextCheck(from); d != tc.expected {
+			t.Fatalf("with -tick-offset %s and -start-lead %s, expected a delay of %s from %s, got %s", tc.offset, tc.lead, tc.expected, tc.from, d)
+		}
+	}
+}
+
+func TestAlignStarts(t *testing.T) {
+	defer func(align bool, interval time.Duration) {
+		*alignStarts = align
+		tickInterval = interval
+	}(*alignStarts, tickInterval)
+	jobs, err := ParseJobs("test", "minutely * * * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := jobs[0]
+	tickInterval = time.Second
+	check := time.Date(2021, 6, 1, 10, 0, 30, 500000000, time.UTC)
+	top := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	*alignStarts = false
+	if due := dueTime(check); !due.Equal(check) || !jobDue(j, &due) {
+		t.Fatal("expected the job to be due at the -tick-offset second")
+	}
+	if !dueTime(top).Equal(top) || jobDue(j, &top) {
+		t.Fatal("expected the job not to be due at the top of the minute")
+	}
+
+	*alignStarts = true
+	check = check.Add(-30 * time.Second)
+	if due := dueTime(check); !due.Equal(top) || !jobDue(j, &due) {
+		t.Fatalf("expected the job to be due at %s, got %s", top, due)
+	}
+	if due := dueTime(check.Add(30 * time.Second)); jobDue(j, &due) {
+		t.Fatal("expected the job not to be due at the -tick-offset second")
+	}
+}
+
+func TestConsecutiveFailures(t *testing.T) {
+	name := "consecutive-test"
+	initJobMetrics(name)
+	defer deleteJobMetrics(name)
+	exit := func(command string) {
+		cmd := exec.Command("/bin/sh", "-c", command)
+		err := cmd.Run()
+		runningGauge.WithLabelValues(name).Inc()
+		runningJobsGauge.Inc()
+		onJobExit(name, time.Second, cmd, err)
+	}
+	for i, tc := range []struct {
+		command  string
+		expected float64
+	}{
+		{"exit 1", 1},
+		{"exit 2", 2},
+		{"exit 1", 3},
+		{"true", 0},
+		{"exit 1", 1},
+	} {
+		exit(tc.command)
+		if v := testutil.ToFloat64(consecutiveFailuresGauge.WithLabelValues(name)); v != tc.expected {
+			t.Fatalf("run %d: expected %v consecutive failures, got %v", i+1, tc.expected, v)
+		}
+	}
+}
+
+func TestUnhealthyJobs(t *testing.T) {
+	defer setCurrentJobs(nil)
+	jobs, err := ParseJobs("test", "unhealthy-ok * * * * * true\nunhealthy-failed * * * * * false\nunhealthy-never * * * * * true\n@disabled\nunhealthy-disabled * * * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setCurrentJobs(jobs)
+	recordExitStatus("unhealthy-ok", 1)
+	recordExitStatus("unhealthy-ok", 0)
+	recordExitStatus("unhealthy-failed", 0)
+	recordExitStatus("unhealthy-failed", 2)
+	defer func() {
+		statusMu.Lock()
+		delete(lastExitStatus, "unhealthy-ok")
+		delete(lastExitStatus, "unhealthy-failed")
+		statusMu.Unlock()
+	}()
+	names := unhealthyJobs()
+	expected := []string{"unhealthy-failed", "unhealthy-never"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected unhealthy jobs %v, got %v", expected, names)
+	}
+}
+
+func TestFlagFileSkip(t *testing.T) {
+	dir := t.TempDir()
+	flagFile := filepath.Join(dir, "maintenance")
+	jobs, err := ParseJobs("test", "@skip-if-exists "+flagFile+"\na * * * * * true\n@run-if-exists "+flagFile+"\nb * * * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := jobs[0], jobs[1]
+	if reason := flagFileSkip(a); reason != "" {
+		t.Fatalf("expected a to run without %s, got %q", flagFile, reason)
+	}
+	if reason := flagFileSkip(b); reason != flagFile+" does not exist" {
+		t.Fatalf("expected b to be skipped without %s, got %q", flagFile, reason)
+	}
+	err = ioutil.WriteFile(flagFile, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := flagFileSkip(a); reason != flagFile+" exists" {
+		t.Fatalf("expected a to be skipped with %s, got %q", flagFile, reason)
+	}
+	if reason := flagFileSkip(b); reason != "" {
+		t.Fatalf("expected b to run with %s, got %q", flagFile, reason)
+	}
+}
+
+// fakeClock is a Clock that only moves when advanced. Each call to
+// After is sent on waiting, so tests know when the scheduler is idle.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []fakeTimer
+	waiting chan time.Duration
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	timer := fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	c.mu.Unlock()
+	c.waiting <- d
+	return timer.c
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	var pending []fakeTimer
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+func TestSchedule(t *testing.T) {
+	fake := &fakeClock{
+		now:     time.Date(2021, 6, 1, 10, 0, 10, 0, time.UTC),
+		waiting: make(chan time.Duration),
+	}
+	clock = fake
+	defer func() { clock = realClock{} }()
+
+	jobs, err := ParseJobs("test", "schedule-test 1 * * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := jobs[0]
+	initJobMetrics(j.Name)
+	defer deleteJobMetrics(j.Name)
+
+	done := make(chan struct{})
+	finished := make(chan []*Job)
+	go func() {
+		finished <- schedule(jobs, done)
+	}()
+
+	// The first check is midway through the next minute.
+	if d := <-fake.waiting; d != 80*time.Second {
+		t.Fatalf("expected to wait 80s for the first check, waited %s", d)
+	}
+	fake.Advance(80 * time.Second)
+	<-fake.waiting
+	if j.IsRunning() {
+		t.Fatal("job ran at 10:00")
+	}
+	fake.Advance(time.Minute)
+	<-fake.waiting
+	j.Wait()
+	if v := testutil.ToFloat64(successCounter.WithLabelValues(j.Name)); v != 1 {
+		t.Fatalf("expected the job to run once at 10:01, it succeeded %v times", v)
+	}
+	// Jobs are checked against the previous check, so the run for 10:01
+	// starts at the 10:02:30 check.
+	if v := testutil.ToFloat64(scheduleDriftGauge.WithLabelValues(j.Name)); v != 90 {
+		t.Fatalf("expected the job to start 90s after 10:01, drift was %vs", v)
+	}
+
+	jumps := testutil.ToFloat64(forwardTimeSkips)
+	fake.Advance(time.Hour)
+	<-fake.waiting
+	if v := testutil.ToFloat64(forwardTimeSkips); v != jumps+1 {
+		t.Fatalf("expected a forward time jump to be counted")
+	}
+
+	close(done)
+	if jobs := <-finished; len(jobs) != 1 {
+		t.Fatalf("expected 1 job back from the scheduler, got %d", len(jobs))
+	}
+}
+
+// tickCount is how many tick durations have been observed.
+func tickCount(t *testing.T) uint64 {
+	var m dto.Metric
+	err := tickDurationHistogram.Write(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestSchedulerMetrics(t *testing.T) {
+	fake := &fakeClock{
+		now:     time.Date(2021, 6, 1, 10, 0, 10, 0, time.UTC),
+		waiting: make(chan time.Duration),
+	}
+	clock = fake
+	defer func() { clock = realClock{} }()
+	defer func(saved tabFiles) { tabs = saved }(tabs)
+	path := filepath.Join(t.TempDir(), "crontab")
+	writeFile(t, path, "metrics-a 0 0 1 1 * true\nmetrics-b 0 0 1 1 * true\n")
+	tabs = tabFiles{path}
+
+	jobs, err := ParseJobs("test", "metrics-a 0 0 1 1 * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"metrics-a", "metrics-b"} {
+		initJobMetrics(name)
+		defer deleteJobMetrics(name)
+	}
+	select {
+	case <-reloadRequests:
+	default:
+	}
+	done := make(chan struct{})
+	finished := make(chan []*Job)
+	go func() {
+		finished <- schedule(jobs, done)
+	}()
+
+	<-fake.waiting
+	ticks := tickCount(t)
+	for i, check := range []time.Time{
+		time.Date(2021, 6, 1, 10, 1, 30, 0, time.UTC),
+		time.Date(2021, 6, 1, 10, 2, 30, 0, time.UTC),
+	} {
+		fake.Advance(check.Sub(fake.Now()))
+		<-fake.waiting
+		if v := testutil.ToFloat64(lastTickGauge); v != float64(check.Unix()) {
+			t.Fatalf("expected the last tick at %s, got %v", check, v)
+		}
+		if n := tickCount(t) - ticks; n != uint64(i+1) {
+			t.Fatalf("expected %d tick durations observed, got %d", i+1, n)
+		}
+	}
+
+	requestReload()
+	<-fake.waiting
+	if v := testutil.ToFloat64(jobsConfiguredGauge); v != 2 {
+		t.Fatalf("expected 2 jobs configured after reloading, got %v", v)
+	}
+	// Reloading isn't a tick.
+	if n := tickCount(t) - ticks; n != 2 {
+		t.Fatalf("expected 2 tick durations observed after reloading, got %d", n)
+	}
+	close(done)
+	<-finished
+}
+
+func TestQueuedRunDrift(t *testing.T) {
+	fake := &fakeClock{
+		now:     time.Date(2021, 6, 1, 10, 1, 30, 0, time.UTC),
+		waiting: make(chan time.Duration, 10),
+	}
+	clock = fake
+	defer func() { clock = realClock{} }()
+
+	jobs, err := ParseJobs("test", "@overlap queue\nqueued-drift-test * * * * * sleep 0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := jobs[0]
+	initJobMetrics(j.Name)
+	defer deleteJobMetrics(j.Name)
+
+	done := make(chan struct{})
+	defer close(done)
+	dispatchJob(j, time.Date(2021, 6, 1, 10, 1, 0, 0, time.UTC), 0, 0, done)
+	for !j.started() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !j.QueueRun() {
+		t.Fatal("expected a run to be queued while the job runs")
+	}
+	// The queued run starts a minute later, but it wasn't scheduled
+	// for then, so mustn't count as drift.
+	fake.Advance(time.Minute)
+	j.Wait()
+	if v := testutil.ToFloat64(successCounter.WithLabelValues(j.Name)); v != 2 {
+		t.Fatalf("expected the job and its queued run to succeed, got %v", v)
+	}
+	if v := testutil.ToFloat64(scheduleDriftGauge.WithLabelValues(j.Name)); v != 30 {
+		t.Fatalf("expected the drift of the scheduled run, 30s, got %vs", v)
+	}
+}
+
+func TestRunJobOnce(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		tab      string
+		expected int
+	}{
+		{"ok * * * * * true", 0},
+		{"fail * * * * * exit 3", 3},
+		{"@exec\nmissing * * * * * /nonexistent/command", 127},
+		// Retried until it succeeds, or exits with the last attempt's status.
+		{"@retry 1 10ms\nflaky * * * * * test -e " + dir + "/ran || { touch " + dir + "/ran; exit 1; }", 0},
+		{"@retry 2 10ms\nfailing * * * * * exit 4", 4},
+	} {
+		jobs, err := ParseJobs("test", tc.tab)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := runJobOnce(jobs[0], nil); status != tc.expected {
+			t.Fatalf("running %q, expected exit status %d, got %d", tc.tab, tc.expected, status)
+		}
+	}
+}
+
+func TestRunJobOnceSignal(t *testing.T) {
+	// Without exec, the sleep is the shell's child, so only signalling
+	// the process group stops it. The retry must be given up.
+	j := &Job{Name: "run-once-test", Command: "sleep 10; true", Retries: 3, RetryBackoff: time.Second}
+	sigs := make(chan os.Signal, 1)
+	go func() {
+		for !j.started() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		sigs <- syscall.SIGINT
+	}()
+	start := time.Now()
+	if status := runJobOnce(j, sigs); status == 0 {
+		t.Fatal("expected the interrupted job to fail")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Fatalf("expected the job to stop soon after SIGINT, took %s", took)
+	}
+}
+
+func TestWaitForJobs(t *testing.T) {
+	defer func(saved time.Duration) { killDelay = saved }(killDelay)
+	killDelay = 200 * time.Millisecond
+
+	// Jobs finishing within the grace period, or with no grace period
+	// at all, are waited for.
+	for _, grace := range []time.Duration{5 * time.Second, 0} {
+		j := &Job{Name: "wait-test", Command: "sleep 0.1"}
+		j.Start(func(string, time.Duration, *exec.Cmd, error) {})
+		if !waitForJobs([]*Job{j}, grace) {
+			t.Fatalf("with grace %s, expected the job to finish by itself", grace)
+		}
+		if j.IsRunning() {
+			t.Fatalf("with grace %s, expected the job to have finished", grace)
+		}
+	}
+
+	// SIGTERM reaches the sleep the shell started, which holds the
+	// output pipe open.
+	j := &Job{Name: "wait-test", Command: "sleep 30; true", OutputLimit: 1000}
+	j.Start(func(string, time.Duration, *exec.Cmd, error) {})
+	for !j.started() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	start := time.Now()
+	if waitForJobs([]*Job{j}, 50*time.Millisecond) {
+		t.Fatal("expected the job to need terminating")
+	}
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Fatalf("expected SIGTERM to end the job promptly, took %s", took)
+	}
+
+	// A job that never finishes is given up on after SIGKILL.
+	stuck := &Job{Name: "stuck-test"}
+	stuck.wg.Add(1)
+	defer stuck.wg.Done()
+	atomic.StoreInt32(&stuck.running, 1)
+	start = time.Now()
+	if waitForJobs([]*Job{stuck}, 50*time.Millisecond) {
+		t.Fatal("expected the stuck job to need terminating")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Fatalf("expected to give up on the stuck job, took %s", took)
+	}
+}
+
+func TestAcquireJobSlot(t *testing.T) {
+	defer func(saved chan struct{}, policy string) {
+		jobSlots = saved
+		*concurrencyPolicy = policy
+	}(jobSlots, *concurrencyPolicy)
+	for _, tc := range []struct {
+		policy   string
+		release  bool
+		acquired bool
+	}{
+		// Over the limit, skipping gives up straight away.
+		{"skip", false, false},
+		// Queueing waits for a slot, or until shutting down.
+		{"queue", true, true},
+		{"queue", false, false},
+	} {
+		*concurrencyPolicy = tc.policy
+		jobSlots = make(chan struct{}, 1)
+		if !acquireJobSlot("slot-test", nil) {
+			t.Fatalf("%s: expected the first slot to be free", tc.policy)
+		}
+		done := make(chan struct{})
+		go func(release bool) {
+			time.Sleep(20 * time.Millisecond)
+			if release {
+				releaseJobSlot()
+			} else {
+				close(done)
+			}
+		}(tc.release)
+		if acquired := acquireJobSlot("slot-test", done); acquired != tc.acquired {
+			t.Fatalf("%s, release %v: expected acquired %v, got %v", tc.policy, tc.release, tc.acquired, acquired)
+		}
+	}
+
+	jobSlots = nil
+	for i := 0; i < 10; i++ {
+		if !acquireJobSlot("slot-test", nil) {
+			t.Fatal("expected no limit without -max-concurrent")
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	defer func(saved tabFiles) { tabs = saved }(tabs)
+	path := filepath.Join(t.TempDir(), "crontab")
+	tabs = tabFiles{path}
+	for _, tc := range []struct {
+		tab      string
+		expected string
+	}{
+		{"a * * * * * true\nb 0 * * * * echo b\n", "a - true\nb - echo b\n" + path + ": 2 jobs ok\n"},
+		{"", path + ": 0 jobs ok\n"},
+		// Errors give the table, line and column, then the line itself.
+		{"a * * * * * true\na 0 * * * * true\n", "parse error " + path + ":2:1 duplicate job name a, first used at " + path + ":1\n\ta 0 * * * * true\n\t^"},
+		{"a * * * * * true\nb 61 * * * * true\n", "parse error " + path + ":2:3 "},
+	} {
+		writeFile(t, path, tc.tab)
+		var got string
+		jobs, err := loadJobs()
+		if err != nil {
+			got = err.Error()
+		} else {
+			var buf strings.Builder
+			writeCheckReport(&buf, jobs)
+			got = buf.String()
+		}
+		if !strings.HasPrefix(got, tc.expected) {
+			t.Fatalf("checking %q, expected %q, got %q", tc.tab, tc.expected, got)
+		}
+	}
+}
+
+func TestWriteSchedule(t *testing.T) {
+	defer func(printJSON bool) { *printScheduleJSON = printJSON }(*printScheduleJSON)
+	jobs, err := ParseJobs("test", "# desc: hourly report\nhourly 0 * * * * true\nhalf 30 * * * * true\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2021, 6, 1, 10, 0, 0, 0, time.Local)
+	for _, tc := range []struct {
+		json     bool
+		expected string
+	}{
+		{false, "2021/06/01 10:30 - half\n2021/06/01 11:00 - hourly - hourly report\n"},
+		{true, `[
+  {
+    "time": "2021-06-01T10:30:00` + from.Format("Z07:00") + `",
+    "job": "half"
+  },
+  {
+    "time": "2021-06-01T11:00:00` + from.Format("Z07:00") + `",
+    "job": "hourly",
+    "description": "hourly report"
+  }
+]
+`},
+	} {
+		*printScheduleJSON = tc.json
+		var buf strings.Builder
+		err := writeSchedule(&buf, jobs, from, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.expected {
+			t.Fatalf("expected:\n%s\ngot:\n%s", tc.expected, buf.String())
+		}
+	}
+}
+
+func TestWriteNextRuns(t *testing.T) {
+	defer func(horizon time.Duration) { *nextHorizon = horizon }(*nextHorizon)
+	*nextHorizon = 48 * time.Hour
+	jobs, err := ParseJobs("test", `hourly 0 * * * * true
+daily 15 3 * * * true
+yearly 0 0 1 jan * true
+poll @every 90s true
+@disabled
+off 0 * * * * true
+@keepalive
+tunnel * * * * * true
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	writeNextRuns(&buf, jobs, time.Date(2021, 6, 1, 10, 0, 0, 0, time.Local))
+	// Sorted by name.
+	expected := `daily - 2021/06/02 03:15
+hourly - 2021/06/01 11:00
+off - disabled
+poll - every 1m30s
+tunnel - kept alive
+yearly - none within 48h0m0s
+`
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestForwardSignal(t *testing.T) {
+	for _, sig := range []syscall.Signal{syscall.SIGINT, syscall.SIGTERM} {
+		j := &Job{Name: "forward-test", Command: "exec sleep 30"}
+		idle := &Job{Name: "forward-idle", Command: "true"}
+		exited := make(chan error, 1)
+		j.Start(func(_ string, _ time.Duration, _ *exec.Cmd, err error) { exited <- err })
+		for !j.started() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		forwardSignal([]*Job{j, idle}, sig)
+		var err error
+		select {
+		case err = <-exited:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %s to stop the job", sig)
+		}
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok || exitErr.Sys().(syscall.WaitStatus).Signal() != sig {
+			t.Fatalf("expected the job to be ended by %s, got %v", sig, err)
+		}
+		j.Wait()
+	}
+}
+
+func TestHealthAndReloadHandlers(t *testing.T) {
+	defer atomic.StoreInt32(&schedulerRunning, atomic.LoadInt32(&schedulerRunning))
+	for _, tc := range []struct {
+		running int32
+		handler http.HandlerFunc
+		method  string
+		status  int
+		reload  bool
+	}{
+		{0, healthHandler, http.MethodGet, http.StatusServiceUnavailable, false},
+		{1, healthHandler, http.MethodGet, http.StatusOK, false},
+		{1, reloadHandler, http.MethodGet, http.StatusMethodNotAllowed, false},
+		{1, reloadHandler, http.MethodPost, http.StatusOK, true},
+	} {
+		select {
+		case <-reloadRequests:
+		default:
+		}
+		atomic.StoreInt32(&schedulerRunning, tc.running)
+		w := httptest.NewRecorder()
+		tc.handler(w, httptest.NewRequest(tc.method, "/", nil))
+		if w.Code != tc.status {
+			t.Fatalf("%s with the scheduler running %d, expected status %d, got %d", tc.method, tc.running, tc.status, w.Code)
+		}
+		select {
+		case <-reloadRequests:
+			if !tc.reload {
+				t.Fatalf("%s, expected no reload to be requested", tc.method)
+			}
+		default:
+			if tc.reload {
+				t.Fatalf("%s, expected a reload to be requested", tc.method)
+			}
+		}
+	}
+}
+
+func TestRecordTimeJump(t *testing.T) {
+	defer func(command string) { *timeJumpCommand = command }(*timeJumpCommand)
+	dir := t.TempDir()
+	for i, tc := range []struct {
+		jump     time.Duration
+		forward  float64
+		backward float64
+		// The jump told to the command, empty if it isn't run.
+		command string
+	}{
+		{10 * time.Minute, 1, 0, "600"},
+		{-10 * time.Minute, 0, 1, "-600"},
+		{time.Minute, 1, 0, ""},
+		{-time.Minute, 0, 1, ""},
+	} {
+		out := filepath.Join(dir, strconv.Itoa(i))
+		*timeJumpCommand = "echo $PROMCRON_TIME_JUMP_SECONDS > " + out + ".tmp && mv " + out + ".tmp " + out
+		forward := testutil.ToFloat64(forwardTimeSkips)
+		backward := testutil.ToFloat64(backwardTimeSkips)
+		recordTimeJump(tc.jump)
+		if v := testutil.ToFloat64(timeJumpGauge); v != tc.jump.Seconds() {
+			t.Fatalf("expected a jump of %v seconds, got %v", tc.jump.Seconds(), v)
+		}
+		if testutil.ToFloat64(forwardTimeSkips)-forward != tc.forward || testutil.ToFloat64(backwardTimeSkips)-backward != tc.backward {
+			t.Fatalf("jumping %s, expected %v forward and %v backward skips counted", tc.jump, tc.forward, tc.backward)
+		}
+		if tc.command == "" {
+			// Give a wrongly started command time to run.
+			time.Sleep(100 * time.Millisecond)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		var got []byte
+		for {
+			got, _ = ioutil.ReadFile(out)
+			if tc.command == "" || len(got) != 0 || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if strings.TrimSpace(string(got)) != tc.command {
+			t.Fatalf("jumping %s, expected the command to be told %q, got %q", tc.jump, tc.command, got)
+		}
+	}
+}
+
+func TestJobHooks(t *testing.T) {
+	dir := t.TempDir()
+	hook := func(what string) string {
+		out := filepath.Join(dir, what)
+		return "echo " + what + " $PROMCRON_JOB $PROMCRON_EXIT_CODE $GREETING > " + out + ".tmp && mv " + out + ".tmp " + out
+	}
+	for i, tc := range []struct {
+		command  string
+		expected string
+	}{
+		{"true", "success hook-test-0 0 hello"},
+		{"exit 3", "failure hook-test-1 3 hello"},
+	} {
+		name := "hook-test-" + strconv.Itoa(i)
+		jobs, err := ParseJobs("test", "GREETING=hello\n@on-success "+hook("success")+"\n@on-failure "+hook("failure")+"\n"+name+" * * * * * "+tc.command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j := jobs[0]
+		initJobMetrics(j.Name)
+		defer deleteJobMetrics(j.Name)
+		os.Remove(filepath.Join(dir, "success"))
+		os.Remove(filepath.Join(dir, "failure"))
+
+		dispatchJob(j, time.Time{}, 0, 0, make(chan struct{}))
+		j.Wait()
+		what := strings.Fields(tc.expected)[0]
+		deadline := time.Now().Add(5 * time.Second)
+		var got []byte
+		for len(got) == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			got, _ = ioutil.ReadFile(filepath.Join(dir, what))
+		}
+		if strings.TrimSpace(string(got)) != tc.expected {
+			t.Fatalf("running %q, expected the %s hook to be told %q, got %q", tc.command, what, tc.expected, got)
+		}
+		// Only one of the hooks runs.
+		time.Sleep(100 * time.Millisecond)
+		other := map[string]string{"success": "failure", "failure": "success"}[what]
+		if _, err := os.Stat(filepath.Join(dir, other)); err == nil {
+			t.Fatalf("running %q, expected the %s hook not to run", tc.command, other)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	defer func(saved bool) { *dryRun = saved }(*dryRun)
+	defer log.SetOutput(os.Stderr)
+	dir := t.TempDir()
+	for i, tc := range []struct {
+		dryRun bool
+		ran    bool
+		logged string
+	}{
+		{true, false, "dry run: would start job dry-run-test-0"},
+		{false, true, "starting job dry-run-test-1"},
+	} {
+		name := "dry-run-test-" + strconv.Itoa(i)
+		out := filepath.Join(dir, name)
+		j := &Job{Name: name, Command: "touch " + out}
+		initJobMetrics(name)
+		defer deleteJobMetrics(name)
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		*dryRun = tc.dryRun
+		dispatchJob(j, time.Time{}, 0, 0, make(chan struct{}))
+		j.Wait()
+		log.SetOutput(os.Stderr)
+		if _, err := os.Stat(out); (err == nil) != tc.ran {
+			t.Fatalf("with -dry-run %v, expected the job to run %v", tc.dryRun, tc.ran)
+		}
+		if !strings.Contains(buf.String(), tc.logged) {
+			t.Fatalf("with -dry-run %v, expected %q logged, got %q", tc.dryRun, tc.logged, buf.String())
+		}
+		if v := testutil.ToFloat64(successCounter.WithLabelValues(name)); tc.dryRun && v != 0 {
+			t.Fatalf("expected no successes counted for a dry run, got %v", v)
+		}
+	}
+}
+
+func TestShutdownMetricsServer(t *testing.T) {
+	for _, tc := range []struct {
+		grace   time.Duration
+		handler time.Duration
+		// Whether the request in progress is finished.
+		finished bool
+	}{
+		{0, 100 * time.Millisecond, true},
+		{5 * time.Second, 100 * time.Millisecond, true},
+		{50 * time.Millisecond, 2 * time.Second, false},
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		handling := make(chan struct{})
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(handling)
+			time.Sleep(tc.handler)
+			fmt.Fprintln(w, "ok")
+		})}
+		go srv.Serve(l)
+		responses := make(chan error, 1)
+		go func() {
+			resp, err := http.Get("http://" + l.Addr().String())
+			if err == nil {
+				resp.Body.Close()
+			}
+			responses <- err
+		}()
+		<-handling
+		start := time.Now()
+		err = shutdownMetricsServer(srv, tc.grace)
+		if (err == nil) != tc.finished {
+			t.Fatalf("with grace %s, expected the request finished %v, got %v", tc.grace, tc.finished, err)
+		}
+		if tc.finished {
+			if err := <-responses; err != nil {
+				t.Fatalf("with grace %s, expected the request to be answered, got %s", tc.grace, err)
+			}
+		} else if took := time.Since(start); took > time.Second {
+			t.Fatalf("with grace %s, expected to stop waiting, took %s", tc.grace, took)
+		}
+		srv.Close()
+	}
+}
+
+func TestListenMetrics(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "stale.sock")
+	l, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	file := filepath.Join(dir, "file")
+	writeFile(t, file, "not a socket\n")
+
+	for _, tc := range []struct {
+		addr string
+		ok   bool
+	}{
+		{"127.0.0.1:0", true},
+		{"unix:" + filepath.Join(dir, "metrics.sock"), true},
+		// A socket left behind by an unclean exit is replaced.
+		{"unix:" + stale, true},
+		// Anything else is never removed.
+		{"unix:" + file, false},
+	} {
+		l, err := listenMetrics(tc.addr)
+		if !tc.ok {
+			if err == nil {
+				l.Close()
+				t.Fatalf("expected listening on %s to fail", tc.addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("listening on %s: %s", tc.addr, err)
+		}
+		srv := &http.Server{Handler: http.HandlerFunc(healthHandler)}
+		go srv.Serve(l)
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, l.Addr().Network(), l.Addr().String())
+			},
+		}}
+		resp, err := client.Get("http://promcron/healthz")
+		if err != nil {
+			t.Fatalf("requesting over %s: %s", tc.addr, err)
+		}
+		resp.Body.Close()
+		srv.Close()
+		if path := strings.TrimPrefix(tc.addr, "unix:"); path != tc.addr {
+			if _, err := os.Lstat(path); err == nil {
+				t.Fatalf("expected %s to be removed once closed", path)
+			}
+		}
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("expected %s to be left alone, got %s", file, err)
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	defer func(saved string) { *metricsAuth = saved }(*metricsAuth)
+	for _, tc := range []struct {
+		auth           string
+		user, password string
+		// Whether the request has credentials at all.
+		basic  bool
+		status int
+	}{
+		{"", "", "", false, http.StatusOK},
+		{"prom:secret", "", "", false, http.StatusUnauthorized},
+		{"prom:secret", "prom", "secret", true, http.StatusOK},
+		{"prom:secret", "prom", "wrong", true, http.StatusUnauthorized},
+		{"prom:secret", "other", "secret", true, http.StatusUnauthorized},
+		// Passwords may contain colons.
+		{"prom:se:cret", "prom", "se:cret", true, http.StatusOK},
+	} {
+		*metricsAuth = tc.auth
+		h := requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "ok")
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tc.basic {
+			r.SetBasicAuth(tc.user, tc.password)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Fatalf("with -metrics-auth %q and %q:%q, expected status %d, got %d", tc.auth, tc.user, tc.password, tc.status, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Fatal("expected a challenge for the credentials")
+		}
+	}
+}
+
+func TestCheckCommands(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+	for _, tc := range []struct {
+		tab    string
+		failed int
+		logged string
+	}{
+		{"a * * * * * echo hello | tr a-z A-Z", 0, ""},
+		{"a * * * * * if true; then echo", 1, "job a has an invalid command: "},
+		{"a * * * * * echo 'unterminated\nb * * * * * true\nc * * * * * (", 2, "job c has an invalid command: "},
+		{"@exec\na * * * * * sh -c true", 0, ""},
+		{"@exec\na * * * * * /nonexistent/command", 1, "job a has an invalid command: "},
+		// Only the syntax is checked, nothing is run.
+		{"a * * * * * exit 1", 0, ""},
+	} {
+		jobs, err := ParseJobs("test", tc.tab)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		failed := checkCommands(jobs)
+		log.SetOutput(os.Stderr)
+		if failed != tc.failed {
+			t.Fatalf("checking %q, expected %d failures, got %d: %s", tc.tab, tc.failed, failed, buf.String())
+		}
+		if !strings.Contains(buf.String(), tc.logged) {
+			t.Fatalf("checking %q, expected %q logged, got %q", tc.tab, tc.logged, buf.String())
+		}
+	}
+}
+
+func TestJobResourceUsage(t *testing.T) {
+	name := "rusage-test"
+	initJobMetrics(name)
+	defer deleteJobMetrics(name)
+	// Run in order as the same job, so each run replaces the last's usage.
+	for _, tc := range []struct {
+		tab string
+		// The least and most maxrss expected, in bytes, or no usage.
+		minMaxrss, maxMaxrss float64
+		none                 bool
+	}{
+		// The shell holds 8MB of output, so a maxrss left in kilobytes
+		// would be far too small.
+		{name + " * * * * * x=$(head -c 8000000 /dev/zero | tr '\\0' a)", 8e6, 1e9, false},
+		// A run that never started has no usage.
+		{"@exec\n" + name + " * * * * * /nonexistent/command", 0, 0, true},
+	} {
+		jobs, err := ParseJobs("test", tc.tab)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j := jobs[0]
+		dispatchJob(j, time.Time{}, 0, 0, make(chan struct{}))
+		j.Wait()
+		maxrss := testutil.ToFloat64(maxrssBytesGauge.WithLabelValues(name))
+		if tc.none {
+			utime := testutil.ToFloat64(utimeGauge.WithLabelValues(name))
+			stime := testutil.ToFloat64(stimeGauge.WithLabelValues(name))
+			if !math.IsNaN(maxrss) || !math.IsNaN(utime) || !math.IsNaN(stime) {
+				t.Fatalf("running %q, expected no usage, got maxrss %v, utime %v and stime %v", tc.tab, maxrss, utime, stime)
+			}
+			continue
+		}
+		if maxrss < tc.minMaxrss || maxrss > tc.maxMaxrss {
+			t.Fatalf("running %q, expected a maxrss between %v and %v bytes, got %v", tc.tab, tc.minMaxrss, tc.maxMaxrss, maxrss)
+		}
+	}
+}
+
+func TestStartErrors(t *testing.T) {
+	for _, tc := range []struct {
+		tab         string
+		startErrors float64
+		failures    float64
+	}{
+		{"@exec\nstart-test-0 * * * * * /nonexistent/command", 1, 1},
+		// The shell ran, even though the command it was given wasn't found.
+		{"start-test-1 * * * * * /nonexistent/command", 0, 1},
+		{"start-test-2 * * * * * true", 0, 0},
+	} {
+		jobs, err := ParseJobs("test", tc.tab)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j := jobs[0]
+		initJobMetrics(j.Name)
+		defer deleteJobMetrics(j.Name)
+		dispatchJob(j, time.Time{}, 0, 0, make(chan struct{}))
+		j.Wait()
+		if v := testutil.ToFloat64(startErrorCounter.WithLabelValues(j.Name)); v != tc.startErrors {
+			t.Fatalf("running %q, expected %v start errors, got %v", tc.tab, tc.startErrors, v)
+		}
+		if v := testutil.ToFloat64(failureCounter.WithLabelValues(j.Name)); v != tc.failures {
+			t.Fatalf("running %q, expected %v failures, got %v", tc.tab, tc.failures, v)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// prefixWriter writes to w, starting each line with the result of prefix.
+// Partial lines are buffered until they are complete, so jobs sharing
+// the same underlying writer never interleave within a line.
+type prefixWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix func() string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := len(b)
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i == -1 {
+			p.buf = append(p.buf, b...)
+			break
+		}
+		line := append([]byte(p.prefix()), p.buf...)
+		line = append(line, b[:i+1]...)
+		p.buf = p.buf[:0]
+		b = b[i+1:]
+		if _, err := p.w.Write(line); err != nil {
+			return n - len(b), err
+		}
+	}
+	return n, nil
+}
+
+// Flush writes out any partial line with a trailing newline.
+func (p *prefixWriter) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.buf) == 0 {
+		return nil
+	}
+	line := append([]byte(p.prefix()), p.buf...)
+	line = append(line, '\n')
+	p.buf = p.buf[:0]
+	_, err := p.w.Write(line)
+	return err
+}
+
+func timestampPrefix() string {
+	return time.Now().Format("2006/01/02 15:04:05 ")
+}
+
+// openLogFile opens path for appending, creating it and
+// any missing parent directories.
+func openLogFile(path string) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// limitWriter writes at most limit bytes to w, or everything when limit
+// is zero, passing the number of bytes written to it to count. Once the
+// limit is reached a single note that the output was truncated is
+// written in place of the rest.
+type limitWriter struct {
+	w         io.Writer
+	limit     int64
+	count     func(n int)
+	written   int64
+	truncated bool
+	lastByte  byte
+}
+
+func (l *limitWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	l.count(n)
+	if l.truncated {
+		return n, nil
+	}
+	if l.limit > 0 && l.written+int64(len(b)) > l.limit {
+		b = b[:l.limit-l.written]
+		l.truncated = true
+	}
+	if len(b) > 0 {
+		wn, err := l.w.Write(b)
+		l.written += int64(wn)
+		if err != nil {
+			return wn, err
+		}
+		l.lastByte = b[len(b)-1]
+	}
+	if l.truncated {
+		note := fmt.Sprintf("[output truncated after %d bytes]\n", l.limit)
+		if l.written > 0 && l.lastByte != '\n' {
+			note = "\n" + note
+		}
+		_, err := io.WriteString(l.w, note)
+		if err != nil {
+			return len(b), err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	var (
+		out bytes.Buffer
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+	)
+	shared := writerFunc(func(b []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return out.Write(b)
+	})
+
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &prefixWriter{w: shared, prefix: func() string { return "[" + name + "] " }}
+			for i := 0; i < 100; i++ {
+				w.Write([]byte(name))
+				w.Write([]byte(name + "\n" + name))
+				w.Write([]byte("\n"))
+			}
+			w.Write([]byte("partial"))
+			w.Flush()
+		}()
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 3*201 {
+		t.Fatalf("expected %d lines, got %d", 3*201, len(lines))
+	}
+	for _, l := range lines {
+		name := l[1:2]
+		if l != "["+name+"] "+name+name && l != "["+name+"] "+name && l != "["+name+"] partial" {
+			t.Fatalf("unexpected line %q", l)
+		}
+	}
+}
+
+func TestLimitWriter(t *testing.T) {
+	var out bytes.Buffer
+	counted := 0
+	w := &limitWriter{w: &out, limit: 10, count: func(n int) { counted += n }}
+	for _, s := range []string{"1234\n", "5678", "90abc", "def\n"} {
+		n, err := w.Write([]byte(s))
+		if err != nil || n != len(s) {
+			t.Fatalf("write of %q returned %d, %v", s, n, err)
+		}
+	}
+	expected := "1234\n56789\n[output truncated after 10 bytes]\n"
+	if out.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, out.String())
+	}
+	if counted != 18 {
+		t.Fatalf("expected 18 bytes counted, got %d", counted)
+	}
+
+	out.Reset()
+	w = &limitWriter{w: &out, count: func(int) {}}
+	w.Write([]byte("no limit"))
+	if out.String() != "no limit" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+func TestStdoutAndStderr(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "job.log")
+	dataFile := filepath.Join(dir, "data", "out.csv")
+	command := "echo data; echo problem >&2"
+	for _, tc := range []struct {
+		stdout, stderr string
+		log, data      string
+	}{
+		{"", "", "data\nproblem\n", ""},
+		{dataFile, "", "problem\n", "data\n"},
+		{OutputDiscard, "", "problem\n", ""},
+		{"", dataFile, "data\n", "problem\n"},
+		{dataFile, dataFile, "", "data\nproblem\n"},
+		{OutputDiscard, OutputDiscard, "", ""},
+	} {
+		os.Remove(logFile)
+		os.Remove(dataFile)
+		j := &Job{Name: "test", Command: command, LogFile: logFile, Stdout: tc.stdout, Stderr: tc.stderr}
+		_, _, err := j.run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		log, _ := ioutil.ReadFile(logFile)
+		data, _ := ioutil.ReadFile(dataFile)
+		if string(log) != tc.log || string(data) != tc.data {
+			t.Fatalf("with @stdout %q and @stderr %q, expected %q logged and %q in the data file, got %q and %q",
+				tc.stdout, tc.stderr, tc.log, tc.data, log, data)
+		}
+	}
+}
+
+func TestOutputBytesToStderr(t *testing.T) {
+	defer func(saved *os.File) { os.Stderr = saved }(os.Stderr)
+	stderr, err := ioutil.TempFile(t.TempDir(), "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	os.Stderr = stderr
+	name := "stderr-bytes-test"
+	defer deleteJobMetrics(name)
+	j := &Job{Name: name, Command: "echo out; echo err >&2"}
+	_, _, err = j.run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := testutil.ToFloat64(outputBytesCounter.WithLabelValues(name)); v != 8 {
+		t.Fatalf("expected both streams' 8 bytes counted, got %v", v)
+	}
+	out, _ := ioutil.ReadFile(stderr.Name())
+	if string(out) != "out\nerr\n" {
+		t.Fatalf("expected the output on stderr, got %q", out)
+	}
+}
+
+func TestBackgroundedChild(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "job.log")
+	name := "background-test"
+	defer deleteJobMetrics(name)
+	for _, tc := range []struct {
+		limit  int64
+		within time.Duration
+	}{
+		// Handed the log file directly, the run ends with the shell.
+		{0, 500 * time.Millisecond},
+		// Through a pipe, it ends once the wait for the pipe gives up.
+		{1000, outputWaitDelay + 500*time.Millisecond},
+	} {
+		os.Remove(logFile)
+		before := testutil.ToFloat64(outputBytesCounter.WithLabelValues(name))
+		j := &Job{Name: name, Command: "echo started; sleep 3 &", LogFile: logFile, OutputLimit: tc.limit}
+		start := time.Now()
+		_, _, err := j.run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if took := time.Since(start); took > tc.within {
+			t.Fatalf("with a limit of %d, expected the run to end within %s, took %s", tc.limit, tc.within, took)
+		}
+		log, _ := ioutil.ReadFile(logFile)
+		if string(log) != "started\n" {
+			t.Fatalf("expected the output to be logged, got %q", log)
+		}
+		if v := testutil.ToFloat64(outputBytesCounter.WithLabelValues(name)) - before; v != 8 {
+			t.Fatalf("with a limit of %d, expected 8 bytes counted, got %v", tc.limit, v)
+		}
+	}
+}
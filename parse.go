@@ -2,9 +2,15 @@ package main
 
 import (
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
 	"math"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type bounds struct {
@@ -13,6 +19,7 @@ type bounds struct {
 }
 
 var (
+	secondBound = bounds{0, 59, nil}
 	minuteBound = bounds{0, 59, nil}
 	hourBound   = bounds{0, 23, nil}
 	domBound    = bounds{1, 31, nil}
@@ -30,7 +37,8 @@ var (
 		"nov": 11,
 		"dec": 12,
 	}}
-	dowBound = bounds{0, 6, map[string]uint{
+	// Both 0 and 7 are Sunday, see parseDowField.
+	dowBound = bounds{0, 7, map[string]uint{
 		"sun": 0,
 		"mon": 1,
 		"tue": 2,
@@ -59,6 +67,163 @@ func parseTimeField(field string, r bounds) (uint64, error) {
 	return bits, nil
 }
 
+// parseClockField parses the second, minute or hour field, which in
+// addition to the usual syntax accepts "R" or "~" for a random value in
+// the field's range picked each day, and "A~B" for one from A to B, as in
+// OpenBSD cron. For those the mask holds the values to pick from, and
+// random is set, see Job.Random.
+func parseClockField(field string, r bounds) (bits uint64, random bool, err error) {
+	if field == "R" || field == "r" {
+		field = "~"
+	}
+	if !strings.Contains(field, "~") {
+		bits, err = parseTimeField(field, r)
+		return bits, false, err
+	}
+	lowAndHigh := strings.Split(field, "~")
+	if len(lowAndHigh) != 2 {
+		return 0, false, fmt.Errorf("too many tildes: %s", field)
+	}
+	if strings.ContainsAny(field, ",-/*") {
+		return 0, false, fmt.Errorf("~ cannot be combined with a list, range or step: %s", field)
+	}
+	low, high := r.min, r.max
+	if lowAndHigh[0] != "" {
+		low, err = parseIntOrName(lowAndHigh[0], r.names)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+	if lowAndHigh[1] != "" {
+		high, err = parseIntOrName(lowAndHigh[1], r.names)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+	if low < r.min {
+		return 0, false, fmt.Errorf("beginning of range (%d) below minimum (%d): %s", low, r.min, field)
+	}
+	if high > r.max {
+		return 0, false, fmt.Errorf("end of range (%d) above maximum (%d): %s", high, r.max, field)
+	}
+	if low > high {
+		return 0, false, fmt.Errorf("beginning of range (%d) beyond end of range (%d): %s", low, high, field)
+	}
+	return getBits(low, high, 1), true, nil
+}
+
+// parseDomField parses the day of month field, which in addition to the
+// usual syntax accepts "L" for the last day of the month and "L-N" for
+// N days before the last day. Those are returned as a separate mask
+// with bit N set for "L-N". A lone "?" is the same as "*".
+func parseDomField(field string) (uint64, uint64, error) {
+	if field == "?" {
+		field = "*"
+	}
+	var bits, fromLast uint64
+	ranges := strings.FieldsFunc(field, func(r rune) bool { return r == ',' })
+	for _, expr := range ranges {
+		if expr[0] != 'L' && expr[0] != 'l' {
+			bit, err := parseTimeRange(expr, domBound)
+			if err != nil {
+				return bits, fromLast, err
+			}
+			bits |= bit
+			continue
+		}
+		var offset uint
+		switch {
+		case len(expr) == 1:
+			offset = 0
+		case expr[1] == '-':
+			var err error
+			offset, err = mustParseInt(expr[2:])
+			if err != nil {
+				return bits, fromLast, err
+			}
+			if offset > domBound.max-domBound.min {
+				return bits, fromLast, fmt.Errorf("offset from last day (%d) above maximum (%d): %s", offset, domBound.max-domBound.min, expr)
+			}
+		default:
+			return bits, fromLast, fmt.Errorf("expected L or L-N: %s", expr)
+		}
+		fromLast |= 1 << offset
+	}
+	return bits, fromLast, nil
+}
+
+// parseDowField parses the day of week field, which in addition to the
+// usual syntax accepts "D#N" for the Nth occurrence of weekday D in the
+// month. Those are returned separately, with bit N of nth[D] set.
+// A lone "?" is the same as "*". As in Vixie cron, 7 is also Sunday, and
+// is folded into 0 once any range is expanded, so "5-7" is Friday to Sunday.
+// 7 is only used when written, so "*" and "N/step" still end on Saturday
+// and "1/2" is Monday, Wednesday and Friday.
+func parseDowField(field string) (uint64, [7]uint8, error) {
+	if field == "?" {
+		field = "*"
+	}
+	var (
+		bits uint64
+		nth  [7]uint8
+	)
+	ranges := strings.FieldsFunc(field, func(r rune) bool { return r == ',' })
+	for _, expr := range ranges {
+		dayAndN := strings.Split(expr, "#")
+		if len(dayAndN) == 1 {
+			r := dowBound
+			if !writesDowAboveSaturday(expr) {
+				r.max = 6
+			}
+			bit, err := parseTimeRange(expr, r)
+			if err != nil {
+				return bits, nth, err
+			}
+			if bit&(1<<7) != 0 {
+				bit = bit&^(1<<7) | 1
+			}
+			bits |= bit
+			continue
+		}
+		if len(dayAndN) != 2 {
+			return bits, nth, fmt.Errorf("too many hashes: %s", expr)
+		}
+		if strings.ContainsAny(dayAndN[0], "*-/") {
+			return bits, nth, fmt.Errorf("# cannot be combined with a range or step: %s", expr)
+		}
+		day, err := parseIntOrName(dayAndN[0], dowBound.names)
+		if err != nil {
+			return bits, nth, err
+		}
+		if day > dowBound.max {
+			return bits, nth, fmt.Errorf("day (%d) above maximum (%d): %s", day, dowBound.max, expr)
+		}
+		day %= 7
+		n, err := mustParseInt(dayAndN[1])
+		if err != nil {
+			return bits, nth, err
+		}
+		if n < 1 || n > 5 {
+			return bits, nth, fmt.Errorf("occurrence (%d) should be between 1 and 5: %s", n, expr)
+		}
+		nth[day] |= 1 << n
+	}
+	return bits, nth, nil
+}
+
+// writesDowAboveSaturday reports whether a day of week range has a start
+// or end above 6, so it is checked against a maximum of 7.
+func writesDowAboveSaturday(expr string) bool {
+	rangeAndStep := strings.Split(expr, "/")
+	for _, s := range strings.Split(rangeAndStep[0], "-") {
+		day, err := parseIntOrName(s, dowBound.names)
+		if err == nil && day > 6 {
+			return true
+		}
+	}
+	return false
+}
+
 func parseTimeRange(expr string, r bounds) (uint64, error) {
 	var (
 		start, end, step uint
@@ -68,6 +233,10 @@ func parseTimeRange(expr string, r bounds) (uint64, error) {
 		err              error
 	)
 
+	if strings.HasPrefix(expr, "-") {
+		return 0, fmt.Errorf("negative numbers are not allowed: %s", expr)
+	}
+
 	var extra uint64
 	if lowAndHigh[0] == "*" {
 		start = r.min
@@ -104,9 +273,6 @@ func parseTimeRange(expr string, r bounds) (uint64, error) {
 		if singleDigit {
 			end = r.max
 		}
-		if step > 1 {
-			extra = 0
-		}
 	default:
 		return 0, fmt.Errorf("too many slashes: %s", expr)
 	}
@@ -163,86 +329,1034 @@ func getBits(min, max, step uint) uint64 {
 	return bits
 }
 
+// ParseOptions controls how a crontab is interpreted.
+type ParseOptions struct {
+	// Seconds makes every job take a leading seconds field,
+	// as if the file started with an @seconds directive.
+	Seconds bool
+	// MaxJitter is used for jobs without an @jitter directive.
+	MaxJitter time.Duration
+	// Timeout is used for jobs without an @timeout directive.
+	Timeout time.Duration
+	// LogDir is where jobs without an @log directive write
+	// their output, as <LogDir>/<name>.log.
+	LogDir string
+	// LogTimestamps prefixes each line of job output with the time.
+	LogTimestamps bool
+	// PrefixOutput prefixes each line of job output with the job name.
+	PrefixOutput bool
+	// OutputLimit is used for jobs without an @output-limit directive.
+	OutputLimit int64
+	// ExpandEnv expands $VAR and ${VAR} in commands when parsing, using
+	// promcron's environment and the job's own environment variables.
+	ExpandEnv bool
+	// StrictEnv makes expanding an undefined variable an error,
+	// rather than expanding it to nothing.
+	StrictEnv bool
+	// Splay shifts every job's schedule as if it had an @splay directive.
+	Splay bool
+	// SplaySeed is hashed with each job's name to pick its splay and
+	// the daily values of random fields, so that each host can run
+	// splayed and random jobs at a different time.
+	SplaySeed string
+	// DayAnd makes jobs that restrict both the day of month and the day
+	// of week run only on days matching both, rather than either.
+	DayAnd bool
+	// MinInterval, if not zero, makes it an error for a job to run more
+	// often than this, judged by the shortest time between its next runs.
+	MinInterval time.Duration
+	// Warn, if not nil, is called with problems that aren't errors.
+	Warn func(msg string)
+	// Included, if not nil, is called with the path of each file read by
+	// @include, and each directory listed by @includedir, even if it
+	// turns out to be missing.
+	Included func(path string)
+}
+
+// minIntervalRuns is how many runs of each job are simulated
+// to check it against ParseOptions.MinInterval.
+const minIntervalRuns = 10
+
+// ParseByteSize parses a number of bytes with an optional K, M or G
+// suffix for kibibytes, mebibytes or gibibytes.
+func ParseByteSize(s string) (int64, error) {
+	digits := s
+	multiplier := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			multiplier = 1 << 10
+		case 'm', 'M':
+			multiplier = 1 << 20
+		case 'g', 'G':
+			multiplier = 1 << 30
+		}
+	}
+	if multiplier != 1 {
+		digits = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// jobDirectives are the directives that apply to the job
+// on the next line, keyed by name.
+var jobDirectives = map[string]func(j *Job, arg string) error{
+	"jitter": func(j *Job, arg string) error {
+		jitter, err := time.ParseDuration(arg)
+		if err != nil {
+			return err
+		}
+		if jitter < 0 {
+			return fmt.Errorf("jitter must not be negative: %s", arg)
+		}
+		j.MaxJitter = jitter
+		return nil
+	},
+	"overdue-after": func(j *Job, arg string) error {
+		overdueAfter, err := time.ParseDuration(arg)
+		if err != nil {
+			return err
+		}
+		if overdueAfter <= 0 {
+			return fmt.Errorf("overdue threshold must be positive: %s", arg)
+		}
+		j.OverdueAfter = overdueAfter
+		return nil
+	},
+	"timeout": func(j *Job, arg string) error {
+		timeout, err := time.ParseDuration(arg)
+		if err != nil {
+			return err
+		}
+		if timeout < 0 {
+			return fmt.Errorf("timeout must not be negative: %s", arg)
+		}
+		j.Timeout = timeout
+		return nil
+	},
+	"max-duration": func(j *Job, arg string) error {
+		maxDuration, err := time.ParseDuration(arg)
+		if err != nil {
+			return err
+		}
+		if maxDuration <= 0 {
+			return fmt.Errorf("max duration must be positive: %s", arg)
+		}
+		j.MaxDuration = maxDuration
+		return nil
+	},
+	"retry": func(j *Job, arg string) error {
+		countAndBackoff := strings.Fields(arg)
+		if len(countAndBackoff) != 2 {
+			return fmt.Errorf("expected a retry count and a backoff duration")
+		}
+		retries, err := mustParseInt(countAndBackoff[0])
+		if err != nil {
+			return err
+		}
+		backoff, err := time.ParseDuration(countAndBackoff[1])
+		if err != nil {
+			return err
+		}
+		if backoff < 0 {
+			return fmt.Errorf("backoff must not be negative: %s", countAndBackoff[1])
+		}
+		j.Retries = int(retries)
+		j.RetryBackoff = backoff
+		return nil
+	},
+	"log": func(j *Job, arg string) error {
+		if arg == "" {
+			return fmt.Errorf("expected a file path")
+		}
+		j.LogFile = arg
+		return nil
+	},
+	"stdout": func(j *Job, arg string) error {
+		if arg == "" {
+			return fmt.Errorf("expected a file path, stdout, stderr or discard")
+		}
+		j.Stdout = arg
+		return nil
+	},
+	"stderr": func(j *Job, arg string) error {
+		if arg == "" {
+			return fmt.Errorf("expected a file path, stdout, stderr or discard")
+		}
+		j.Stderr = arg
+		return nil
+	},
+	"heartbeat": func(j *Job, arg string) error {
+		u, err := url.Parse(arg)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("expected an http or https URL")
+		}
+		j.Heartbeat = arg
+		return nil
+	},
+	"on-success": func(j *Job, arg string) error {
+		if arg == "" {
+			return fmt.Errorf("expected a command")
+		}
+		j.OnSuccess = arg
+		return nil
+	},
+	"on-failure": func(j *Job, arg string) error {
+		if arg == "" {
+			return fmt.Errorf("expected a command")
+		}
+		j.OnFailure = arg
+		return nil
+	},
+	"nice": func(j *Job, arg string) error {
+		nice, err := strconv.Atoi(arg)
+		if err != nil {
+			return err
+		}
+		if nice < -20 || nice > 19 {
+			return fmt.Errorf("niceness must be from -20 to 19")
+		}
+		j.Nice = nice
+		return nil
+	},
+	"ionice": func(j *Job, arg string) error {
+		classAndLevel := strings.SplitN(arg, ":", 2)
+		switch classAndLevel[0] {
+		case "realtime":
+			j.IOClass = IOClassRealtime
+		case "best-effort":
+			j.IOClass = IOClassBestEffort
+		case "idle":
+			if len(classAndLevel) != 1 {
+				return fmt.Errorf("the idle class takes no level")
+			}
+			j.IOClass = IOClassIdle
+			return nil
+		default:
+			return fmt.Errorf("expected 'realtime', 'best-effort' or 'idle'")
+		}
+		j.IOLevel = 4
+		if len(classAndLevel) == 2 {
+			level, err := strconv.Atoi(classAndLevel[1])
+			if err != nil || level < 0 || level > 7 {
+				return fmt.Errorf("level must be from 0 to 7")
+			}
+			j.IOLevel = level
+		}
+		return nil
+	},
+	"output-limit": func(j *Job, arg string) error {
+		limit, err := ParseByteSize(arg)
+		if err != nil {
+			return err
+		}
+		j.OutputLimit = limit
+		return nil
+	},
+	"disabled": func(j *Job, arg string) error {
+		if arg != "" {
+			return fmt.Errorf("unexpected argument %q", arg)
+		}
+		j.Disabled = true
+		return nil
+	},
+	"keepalive": func(j *Job, arg string) error {
+		if arg != "" {
+			return fmt.Errorf("unexpected argument %q", arg)
+		}
+		j.KeepAlive = true
+		return nil
+	},
+	"splay": func(j *Job, arg string) error {
+		if arg != "" {
+			return fmt.Errorf("unexpected argument %q", arg)
+		}
+		j.splay = true
+		return nil
+	},
+	"group": func(j *Job, arg string) error {
+		if arg == "" {
+			return fmt.Errorf("expected the name of a group")
+		}
+		j.Group = arg
+		return nil
+	},
+	"skip-if-exists": func(j *Job, arg string) error {
+		if arg == "" {
+			return fmt.Errorf("expected a path")
+		}
+		j.SkipIfExists = arg
+		return nil
+	},
+	"run-if-exists": func(j *Job, arg string) error {
+		if arg == "" {
+			return fmt.Errorf("expected a path")
+		}
+		j.RunIfExists = arg
+		return nil
+	},
+	"env-file": func(j *Job, arg string) error {
+		if arg == "" {
+			return fmt.Errorf("expected a path")
+		}
+		j.EnvFile = arg
+		return nil
+	},
+	"requires": func(j *Job, arg string) error {
+		if arg == "" {
+			return fmt.Errorf("expected the name of a job")
+		}
+		j.Requires = arg
+		return nil
+	},
+	"exec": func(j *Job, arg string) error {
+		if arg != "" {
+			return fmt.Errorf("unexpected argument %q", arg)
+		}
+		j.Exec = true
+		return nil
+	},
+	"overlap": func(j *Job, arg string) error {
+		switch arg {
+		case OverlapSkip, OverlapQueue, OverlapParallel:
+		default:
+			return fmt.Errorf("expected %q, %q or %q", OverlapSkip, OverlapQueue, OverlapParallel)
+		}
+		j.Overlap = arg
+		return nil
+	},
+}
+
+// parseAssignment parses a "KEY=VALUE" environment assignment line.
+// A line is an assignment when everything before the first '=' is a
+// single word, so job lines are never mistaken for one.
+func parseAssignment(l string) (assignment string, ok bool, err error) {
+	eq := strings.IndexByte(l, '=')
+	if eq == -1 {
+		return "", false, nil
+	}
+	key := strings.TrimSpace(l[:eq])
+	if strings.ContainsAny(key, " \t\"") {
+		return "", false, nil
+	}
+	if !validEnvKey(key) {
+		return "", true, fmt.Errorf("invalid environment variable name %q", key)
+	}
+	value := strings.TrimSpace(l[eq+1:])
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+		if value[len(value)-1] != value[0] {
+			return "", true, fmt.Errorf("unterminated quote in value of %s", key)
+		}
+		value = value[1 : len(value)-1]
+	}
+	return key + "=" + value, true, nil
+}
+
+// parseInterval parses the duration of an @every job, which must be
+// at least a second, like the shortest timespec.
+func parseInterval(s string) (time.Duration, error) {
+	interval, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if interval < time.Second {
+		return 0, fmt.Errorf("%s is less than a second", s)
+	}
+	return interval, nil
+}
+
+// readEnvFile reads the "KEY=VALUE" lines of an @env-file, which are
+// written like assignments in a table. Blank lines and comments are
+// skipped, and anything else is an error.
+func readEnvFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading env file: %w", err)
+	}
+	var env []string
+	for i, l := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(l) == "" || isComment(l) {
+			continue
+		}
+		assignment, ok, err := parseAssignment(l)
+		if !ok {
+			err = fmt.Errorf("expected KEY=VALUE")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing env file %s:%d: %s", path, i+1, err)
+		}
+		env = append(env, assignment)
+	}
+	return env, nil
+}
+
+// stripComment removes a trailing comment from a command. Like the
+// shell, a '#' starts a comment when it begins a word outside of
+// quotes, so "\#" and words like "a#b" are left alone.
+func stripComment(command string) string {
+	var quote rune
+	escaped := false
+	wordStart := true
+	for i, r := range command {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '#' && wordStart:
+			return strings.TrimRight(command[:i], " \t")
+		}
+		wordStart = !escaped && quote == 0 && (r == ' ' || r == '\t')
+	}
+	return command
+}
+
+// splitArgs splits an @exec command into its arguments like the shell
+// would, with single quotes, double quotes and backslash escapes, but
+// without any expansions. On error it also returns the byte offset
+// in command of the problem.
+func splitArgs(command string) ([]string, int, error) {
+	var (
+		args       []string
+		arg        []rune
+		inArg      bool
+		quote      rune
+		quoteStart int
+		escaped    bool
+	)
+	for i, r := range command {
+		switch {
+		case escaped:
+			escaped = false
+			if quote == '"' && r != '"' && r != '\\' && r != '$' && r != '`' {
+				arg = append(arg, '\\')
+			}
+			arg = append(arg, r)
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg = append(arg, r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			quoteStart = i
+			inArg = true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, string(arg))
+				arg = arg[:0]
+				inArg = false
+			}
+		default:
+			arg = append(arg, r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, quoteStart, fmt.Errorf("unterminated %c quote in command", quote)
+	}
+	if escaped {
+		return nil, len(command) - 1, fmt.Errorf("trailing backslash in command")
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+	return args, 0, nil
+}
+
+// expandVars expands $VAR and ${VAR} in command, looking them up in env
+// then in promcron's environment. Special shell parameters like $1 and
+// $? are left for the shell. If strict is set, undefined variables
+// are an error, otherwise they expand to nothing.
+func expandVars(command string, env []string, strict bool) (string, error) {
+	var err error
+	expanded := os.Expand(command, func(name string) string {
+		if !validEnvKey(name) {
+			return "$" + name
+		}
+		for i := len(env) - 1; i >= 0; i-- {
+			if strings.HasPrefix(env[i], name+"=") {
+				return env[i][len(name)+1:]
+			}
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok && strict && err == nil {
+			err = fmt.Errorf("undefined variable %s in command", name)
+		}
+		return value
+	})
+	return expanded, err
+}
+
+func validEnvKey(key string) bool {
+	if key == "" || (key[0] >= '0' && key[0] <= '9') {
+		return false
+	}
+	for _, r := range key {
+		if !(r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+type logicalLine struct {
+	lno  int // The first physical line, counting from one.
+	text string
+}
+
+// joinContinuations splits tab into lines, joining lines that end
+// in a backslash with the next line like the shell does. An even
+// number of trailing backslashes are escaped backslashes, and
+// comment lines are never continued.
+func joinContinuations(tab string) []logicalLine {
+	lines := []logicalLine{}
+	var cur *logicalLine
+	for lno, l := range strings.Split(tab, "\n") {
+		if cur == nil {
+			lines = append(lines, logicalLine{lno: lno + 1})
+			cur = &lines[len(lines)-1]
+			if isComment(l) {
+				cur.text = l
+				cur = nil
+				continue
+			}
+		}
+		trailing := len(l) - len(strings.TrimRight(l, "\\"))
+		if trailing%2 == 1 {
+			cur.text += l[:len(l)-1]
+			continue
+		}
+		cur.text += l
+		cur = nil
+	}
+	return lines
+}
+
+// isComment reports whether a line is a comment, starting with
+// '#' or ';' after any indentation.
+func isComment(l string) bool {
+	l = strings.TrimSpace(l)
+	return strings.HasPrefix(l, "#") || strings.HasPrefix(l, ";")
+}
+
+type directive struct {
+	lno  int
+	name string
+	arg  string
+}
+
 func ParseJobs(fname, tab string) ([]*Job, error) {
-	jobs := []*Job{}
-	lines := strings.Split(tab, "\n")
-	for lno, l := range lines {
+	return ParseJobsWithOptions(fname, tab, ParseOptions{})
+}
+
+// maxIncludeDepth limits how deeply @include directives can nest.
+const maxIncludeDepth = 16
+
+type parser struct {
+	opts ParseOptions
+	jobs []*Job
+	// Job names are metric labels, so they must be unique
+	// across all files, this maps them to where they were used.
+	names map[string]string
+	// The absolute paths of the files currently being included.
+	including map[string]bool
+	depth     int
+}
+
+func ParseJobsWithOptions(fname, tab string, opts ParseOptions) ([]*Job, error) {
+	return ParseTabsWithOptions([]Tab{{Name: fname, Data: tab}}, opts)
+}
+
+// Tab is a named table of jobs.
+type Tab struct {
+	Name string
+	Data string
+}
+
+// ParseTabsWithOptions parses the jobs of several tables, in order. Each
+// table starts afresh as if it were the only one, except that job names
+// must be unique across all of them.
+func ParseTabsWithOptions(tabs []Tab, opts ParseOptions) ([]*Job, error) {
+	p := &parser{
+		opts:      opts,
+		jobs:      []*Job{},
+		names:     make(map[string]string),
+		including: make(map[string]bool),
+	}
+	for _, tab := range tabs {
+		abs, absErr := filepath.Abs(tab.Name)
+		if absErr == nil {
+			p.including[abs] = true
+		}
+		err := p.parse(tab.Name, tab.Data, []string{}, opts.Seconds)
+		if err != nil {
+			return nil, err
+		}
+		if absErr == nil {
+			delete(p.including, abs)
+		}
+	}
+	err := p.checkRequires()
+	if err != nil {
+		return nil, err
+	}
+	return p.jobs, nil
+}
+
+// checkRequires checks that each @requires names a job, and that no
+// job ends up requiring itself.
+func (p *parser) checkRequires() error {
+	byName := make(map[string]*Job)
+	for _, j := range p.jobs {
+		byName[j.Name] = j
+	}
+	for _, j := range p.jobs {
+		if j.Requires == "" {
+			continue
+		}
+		if byName[j.Requires] == nil {
+			return fmt.Errorf("parse error %s job %s requires unknown job %s", p.names[j.Name], j.Name, j.Requires)
+		}
+		chain := []string{j.Name}
+		for r := byName[j.Requires]; r != nil && len(chain) <= len(p.jobs); r = byName[r.Requires] {
+			chain = append(chain, r.Name)
+			if r == j {
+				return fmt.Errorf("parse error %s job %s requires itself: %s", p.names[j.Name], j.Name, strings.Join(chain, " -> "))
+			}
+		}
+	}
+	return nil
+}
+
+func (p *parser) warn(format string, args ...interface{}) {
+	if p.opts.Warn != nil {
+		p.opts.Warn(fmt.Sprintf(format, args...))
+	}
+}
+
+// parse parses the jobs in tab, env and seconds are the environment
+// and @seconds setting in effect at the start of the file.
+func (p *parser) parse(fname, tab string, env []string, seconds bool) error {
+	opts := p.opts
+	pending := []directive{}
+	// description is from "# desc:" lines just before a job.
+	description := ""
+	for _, line := range joinContinuations(tab) {
+		lno, l := line.lno, line.text
 
 		parseError := func(err error) error {
-			return fmt.Errorf("parse error %s:%d %s", fname, lno, err)
+			return fmt.Errorf("parse error %s:%d %s\n\t%s", fname, lno, err, l)
+		}
+		// fieldError points at the start of the offending field,
+		// the column counts bytes from one within the logical line.
+		fieldError := func(offset int, err error) error {
+			marker := []byte(l[:offset])
+			for i := range marker {
+				if marker[i] != '\t' {
+					marker[i] = ' '
+				}
+			}
+			return fmt.Errorf("parse error %s:%d:%d %s\n\t%s\n\t%s^", fname, lno, offset+1, err, l, marker)
 		}
 
-		if strings.TrimSpace(l) == "" || l[0] == '#' {
+		// Everything but job lines is recognised ignoring indentation,
+		// and the trimmed line is never empty past this point.
+		trimmed := strings.TrimSpace(l)
+		if trimmed == "" {
+			// Only directives may come between a description and its job.
+			description = ""
+			continue
+		}
+		if isComment(trimmed) {
+			comment := strings.TrimSpace(trimmed[1:])
+			if strings.HasPrefix(comment, "desc:") {
+				description = strings.TrimSpace(description + " " + strings.TrimSpace(comment[len("desc:"):]))
+			} else {
+				description = ""
+			}
 			continue
 		}
 
-		// Split out our 7 fields
+		if assignment, ok, err := parseAssignment(l); ok {
+			if err != nil {
+				return parseError(err)
+			}
+			// Applies to every following job.
+			env = append(env, assignment)
+			description = ""
+			continue
+		}
+
+		if trimmed[0] == '@' {
+			directiveLine := strings.TrimSpace(trimmed[1:])
+			d := directive{lno: lno, name: directiveLine}
+			if i := strings.IndexAny(directiveLine, " \t"); i != -1 {
+				d.name = directiveLine[:i]
+				d.arg = strings.TrimSpace(directiveLine[i:])
+			}
+			switch d.name {
+			case "seconds":
+				// Every following job has a leading seconds field.
+				seconds = true
+				continue
+			case "include", "includedir":
+				err := p.include(fname, d, env, seconds)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if _, ok := jobDirectives[d.name]; !ok {
+				return parseError(fmt.Errorf("unknown directive @%s", d.name))
+			}
+			pending = append(pending, d)
+			continue
+		}
+
+		// Split out our fields, the command is always last
+		// and absorbs the rest of the line.
+		nFields := 7
+		if seconds {
+			nFields = 8
+		}
 		curField := &strings.Builder{}
 		fields := []string{}
+		// The byte offset each field starts at.
+		fieldStarts := []int{}
 
 		const ST_FIELD = 0
 		const ST_WS = 1
+		// Fields before the command may be double quoted,
+		// with backslash escapes inside the quotes.
+		const ST_QUOTED = 2
+		const ST_ESCAPED = 3
 		state := ST_WS
-		for _, r := range l {
+		for i, r := range l {
 			switch state {
 			case ST_FIELD:
-				if len(fields) != 6 && (r == ' ' || r == '\t') {
+				if len(fields) != nFields-1 && (r == ' ' || r == '\t') {
 					state = ST_WS
 					fields = append(fields, curField.String())
 					curField.Reset()
+					if len(fields) == 2 && fields[1] == "@every" {
+						// An interval replaces the timespec.
+						nFields = 4
+					}
 				} else {
 					curField.WriteRune(r)
 				}
 			case ST_WS:
-				if r != ' ' && r != '\t' {
+				if r == '"' && len(fields) != nFields-1 {
+					state = ST_QUOTED
+					fieldStarts = append(fieldStarts, i)
+				} else if r != ' ' && r != '\t' {
 					state = ST_FIELD
+					fieldStarts = append(fieldStarts, i)
 					curField.WriteRune(r)
 				}
+			case ST_QUOTED:
+				switch r {
+				case '\\':
+					state = ST_ESCAPED
+				case '"':
+					state = ST_FIELD
+				default:
+					curField.WriteRune(r)
+				}
+			case ST_ESCAPED:
+				state = ST_QUOTED
+				curField.WriteRune(r)
 			}
 		}
+		if state == ST_QUOTED || state == ST_ESCAPED {
+			return fieldError(fieldStarts[len(fields)], fmt.Errorf("unterminated quote in field %d", len(fields)+1))
+		}
 		fields = append(fields, curField.String())
 
 		if len(fields) == 0 {
 			continue
 		}
 
-		if len(fields) != 7 {
-			return nil, parseError(fmt.Errorf("expected a label, timespec and a command"))
+		if len(fields) != nFields {
+			return parseError(fmt.Errorf("expected a label, timespec and a command"))
 		}
 
 		name := fields[0]
-		minute, err := parseTimeField(fields[1], minuteBound)
-		if err != nil {
-			return nil, parseError(fmt.Errorf("invalid minute spec: %s", err))
+		if name == "" {
+			return fieldError(fieldStarts[0], fmt.Errorf("empty job name"))
+		}
+		if firstUse, ok := p.names[name]; ok {
+			return fieldError(fieldStarts[0], fmt.Errorf("duplicate job name %s, first used at %s", name, firstUse))
 		}
-		hour, err := parseTimeField(fields[2], hourBound)
+		p.names[name] = fmt.Sprintf("%s:%d", fname, lno)
+		timespec := fields[1 : nFields-1]
+		timespecStarts := fieldStarts[1 : nFields-1]
+
+		var (
+			second, minute, hour, dom, domFromLast, month, dow uint64
+			dowNth                                             [7]uint8
+			randomSecond, randomMinute, randomHour             bool
+			interval                                           time.Duration
+			err                                                error
+		)
+		if timespec[0] == "@every" {
+			interval, err = parseInterval(timespec[1])
+			if err != nil {
+				return fieldError(timespecStarts[1], fmt.Errorf("invalid interval: %s", err))
+			}
+		} else {
+			if seconds {
+				second, randomSecond, err = parseClockField(timespec[0], secondBound)
+				if err != nil {
+					return fieldError(timespecStarts[0], fmt.Errorf("invalid second spec: %s", err))
+				}
+				timespec = timespec[1:]
+				timespecStarts = timespecStarts[1:]
+			}
+
+			minute, randomMinute, err = parseClockField(timespec[0], minuteBound)
+			if err != nil {
+				return fieldError(timespecStarts[0], fmt.Errorf("invalid minute spec: %s", err))
+			}
+			hour, randomHour, err = parseClockField(timespec[1], hourBound)
+			if err != nil {
+				return fieldError(timespecStarts[1], fmt.Errorf("invalid hour spec: %s", err))
+			}
+			dom, domFromLast, err = parseDomField(timespec[2])
+			if err != nil {
+				return fieldError(timespecStarts[2], fmt.Errorf("invalid day of month spec: %s", err))
+			}
+			month, err = parseTimeField(timespec[3], monthBound)
+			if err != nil {
+				return fieldError(timespecStarts[3], fmt.Errorf("invalid month spec: %s", err))
+			}
+			dow, dowNth, err = parseDowField(timespec[4])
+			if err != nil {
+				return fieldError(timespecStarts[4], fmt.Errorf("invalid day of week spec: %s", err))
+			}
+		}
+		command := stripComment(fields[nFields-1])
+		if command == "" {
+			return parseError(fmt.Errorf("empty command"))
+		}
+		if opts.ExpandEnv {
+			var err error
+			command, err = expandVars(command, env, opts.StrictEnv)
+			if err != nil {
+				return fieldError(fieldStarts[nFields-1], err)
+			}
+			if strings.TrimSpace(command) == "" {
+				return fieldError(fieldStarts[nFields-1], fmt.Errorf("command is empty once variables are expanded"))
+			}
+		}
+
+		j := &Job{
+			Name:          name,
+			Schedule:      strings.Join(fields[1:nFields-1], " "),
+			Second:        second,
+			Minute:        minute,
+			Hour:          hour,
+			Dom:           dom,
+			DomFromLast:   domFromLast,
+			Month:         month,
+			Dow:           dow,
+			DowNth:        dowNth,
+			Command:       command,
+			Description:   description,
+			Env:           append([]string{}, env...),
+			MaxJitter:     opts.MaxJitter,
+			Timeout:       opts.Timeout,
+			LogTimestamps: opts.LogTimestamps,
+			PrefixOutput:  opts.PrefixOutput,
+			OutputLimit:   opts.OutputLimit,
+			DayAnd:        opts.DayAnd,
+			Interval:      interval,
+		}
+		if randomSecond {
+			j.Random |= RandomSecond
+		}
+		if randomMinute {
+			j.Random |= RandomMinute
+		}
+		if randomHour {
+			j.Random |= RandomHour
+		}
+		if j.Random != 0 {
+			j.RandomSeed = opts.SplaySeed
+		}
+		if opts.LogDir != "" {
+			j.LogFile = filepath.Join(opts.LogDir, name+".log")
+		}
+
+		for _, d := range pending {
+			err := jobDirectives[d.name](j, d.arg)
+			if err != nil {
+				return fmt.Errorf("parse error %s:%d invalid @%s directive: %s", fname, d.lno, d.name, err)
+			}
+		}
+		pending = pending[:0]
+		description = ""
+		if j.KeepAlive && j.Retries != 0 {
+			return fmt.Errorf("parse error %s:%d job %s cannot use both @keepalive and @retry", fname, lno, name)
+		}
+		if j.KeepAlive && j.Interval != 0 {
+			return fmt.Errorf("parse error %s:%d job %s cannot use both @keepalive and @every", fname, lno, name)
+		}
+
+		if j.splay || opts.Splay {
+			j.Splay = SplayOffset(opts.SplaySeed, name)
+		}
+		if j.Exec {
+			var offset int
+			j.Args, offset, err = splitArgs(command)
+			if err != nil {
+				if opts.ExpandEnv {
+					// The offset is into the expanded command.
+					offset = 0
+				}
+				return fieldError(fieldStarts[nFields-1]+offset, err)
+			}
+			if len(j.Args) == 0 {
+				return fieldError(fieldStarts[nFields-1], fmt.Errorf("command has no arguments"))
+			}
+		}
+
+		if opts.MinInterval != 0 {
+			interval := j.Interval
+			if interval == 0 {
+				interval = j.ShortestInterval(time.Now(), minIntervalRuns)
+			}
+			if interval != 0 && interval < opts.MinInterval {
+				return parseError(fmt.Errorf("job %s runs every %s, more often than the minimum interval of %s", name, interval, opts.MinInterval))
+			}
+		}
+
+		if j.Interval != 0 {
+			// Not scheduled by the timespec fields.
+		} else if !j.CanRun() {
+			p.warn("%s:%d job %s can never run, as no date matches its day of month, month and day of week", fname, lno, name)
+		} else if !j.DayAnd && j.Dom&starBit == 0 && j.Dow&starBit == 0 {
+			p.warn("%s:%d job %s restricts both the day of month and the day of week, so it runs on days matching either", fname, lno, name)
+		}
+
+		p.jobs = append(p.jobs, j)
+	}
+
+	if len(pending) != 0 {
+		d := pending[0]
+		return fmt.Errorf("parse error %s:%d @%s directive is not followed by a job", fname, d.lno, d.name)
+	}
+
+	return nil
+}
+
+// SplayOffset is how far @splay shifts the schedule of the named job,
+// a whole number of minutes under an hour picked by hashing seed and name.
+func SplayOffset(seed, name string) time.Duration {
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	h.Write([]byte{0})
+	h.Write([]byte(name))
+	return time.Duration(h.Sum64()%60) * time.Minute
+}
+
+// IsTabURL reports whether a table name is an http or https URL
+// rather than a path.
+func IsTabURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// ListTabDir lists the tables in dir in name order,
+// skipping subdirectories and hidden files.
+func ListTabDir(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// ReadDir sorts entries by name.
+	paths := []string{}
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, e.Name()))
+	}
+	return paths, nil
+}
+
+// include parses the file or directory of files named by an
+// @include or @includedir directive in fname.
+func (p *parser) include(fname string, d directive, env []string, seconds bool) error {
+	parseError := func(err error) error {
+		return fmt.Errorf("parse error %s:%d %s", fname, d.lno, err)
+	}
+
+	if d.arg == "" {
+		return parseError(fmt.Errorf("@%s expects a path", d.name))
+	}
+	path := d.arg
+	if !filepath.IsAbs(path) {
+		if IsTabURL(fname) {
+			return parseError(fmt.Errorf("@%s paths must be absolute in tables loaded from a URL", d.name))
+		}
+		path = filepath.Join(filepath.Dir(fname), path)
+	}
+
+	if p.opts.Included != nil {
+		p.opts.Included(path)
+	}
+	paths := []string{path}
+	if d.name == "includedir" {
+		var err error
+		paths, err = ListTabDir(path)
 		if err != nil {
-			return nil, parseError(fmt.Errorf("invalid hour spec: %s", err))
+			return parseError(err)
 		}
-		dom, err := parseTimeField(fields[3], domBound)
+	}
+
+	if p.depth == maxIncludeDepth {
+		return parseError(fmt.Errorf("includes nested more than %d deep", maxIncludeDepth))
+	}
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
 		if err != nil {
-			return nil, parseError(fmt.Errorf("invalid day of month spec: %s", err))
+			return parseError(err)
+		}
+		if p.including[abs] {
+			return parseError(fmt.Errorf("include cycle, %s is already being included", path))
 		}
-		month, err := parseTimeField(fields[4], monthBound)
+		data, err := ioutil.ReadFile(path)
 		if err != nil {
-			return nil, parseError(fmt.Errorf("invalid month spec: %s", err))
+			return parseError(err)
 		}
-		dow, err := parseTimeField(fields[5], dowBound)
+		p.including[abs] = true
+		p.depth++
+		// Included files start with the current environment, but
+		// their own settings don't carry over to the including file.
+		err = p.parse(path, string(data), append([]string{}, env...), seconds)
+		p.depth--
+		delete(p.including, abs)
 		if err != nil {
-			return nil, parseError(fmt.Errorf("invalid day of week spec: %s", err))
+			return err
 		}
-		command := fields[6]
-
-		jobs = append(jobs, &Job{
-			Name:    name,
-			Minute:  minute,
-			Hour:    hour,
-			Dom:     dom,
-			Month:   month,
-			Dow:     dow,
-			Command: command,
-		})
 	}
-
-	return jobs, nil
+	return nil
 }
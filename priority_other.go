@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func setIOPriority(pid, class, level int) error {
+	return errors.New("I/O priorities are only supported on linux")
+}
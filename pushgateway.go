@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var pushgatewayErrors = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "promcron_pushgateway_errors",
+	Help: "Times pushing job metrics to the Pushgateway failed.",
+})
+
+// jobGatherer gathers the metrics of a single job from the default
+// registry. The job label is removed, as the Pushgateway takes it
+// from the grouping key instead.
+func jobGatherer(jobName string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			return nil, err
+		}
+		jobMfs := []*dto.MetricFamily{}
+		for _, mf := range mfs {
+			metrics := []*dto.Metric{}
+			for _, m := range mf.Metric {
+				labels := []*dto.LabelPair{}
+				isJob := false
+				for _, l := range m.Label {
+					if l.GetName() == "job" {
+						isJob = l.GetValue() == jobName
+					} else {
+						labels = append(labels, l)
+					}
+				}
+				if isJob {
+					m.Label = labels
+					metrics = append(metrics, m)
+				}
+			}
+			if len(metrics) != 0 {
+				mf.Metric = metrics
+				jobMfs = append(jobMfs, mf)
+			}
+		}
+		return jobMfs, nil
+	})
+}
+
+// pushJobMetrics pushes the metrics of a job to the Pushgateway at url
+// in the background, grouped by job and instance.
+func pushJobMetrics(url, instance, jobName string) {
+	go func() {
+		err := push.New(url, jobName).
+			Grouping("instance", instance).
+			Gatherer(jobGatherer(jobName)).
+			Client(&http.Client{Timeout: 30 * time.Second}).
+			Push()
+		if err != nil {
+			log.Printf("error pushing metrics for job %s: %s", jobName, err)
+			pushgatewayErrors.Inc()
+		}
+	}()
+}
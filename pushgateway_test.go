@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPushJobMetrics(t *testing.T) {
+	for _, name := range []string{"push-test", "push-other"} {
+		initJobMetrics(name)
+		defer deleteJobMetrics(name)
+	}
+	successCounter.WithLabelValues("push-test").Add(3)
+
+	type push struct {
+		method, path, body string
+	}
+	for _, tc := range []struct {
+		status int
+		errors float64
+	}{
+		{http.StatusOK, 0},
+		{http.StatusInternalServerError, 1},
+	} {
+		pushes := make(chan push, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			pushes <- push{r.Method, r.URL.Path, string(body)}
+			w.WriteHeader(tc.status)
+		}))
+		before := testutil.ToFloat64(pushgatewayErrors)
+		pushJobMetrics(srv.URL, "host1", "push-test")
+		var p push
+		select {
+		case p = <-pushes:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the metrics to be pushed")
+		}
+		if p.method != http.MethodPut || p.path != "/metrics/job/push-test/instance/host1" {
+			t.Fatalf("expected a PUT grouped by job and instance, got %s %s", p.method, p.path)
+		}
+		// Pushed as protobuf, but names and label values appear as is.
+		// The job label is left to the grouping key.
+		if !strings.Contains(p.body, "promcron_job_success_count") || strings.Contains(p.body, "push-other") || strings.Contains(p.body, "push-test") {
+			t.Fatalf("expected only the pushed job's metrics, without a job label, got %q", p.body)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for testutil.ToFloat64(pushgatewayErrors)-before != tc.errors && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if v := testutil.ToFloat64(pushgatewayErrors) - before; v != tc.errors {
+			t.Fatalf("with status %d, expected %v errors counted, got %v", tc.status, tc.errors, v)
+		}
+		srv.Close()
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// stdinTab holds the table once read from stdin with -f -,
+// as it can only be read once but may be reloaded.
+var stdinTab []byte
+
+// tabFiles collects each -f flag.
+type tabFiles []string
+
+func (t *tabFiles) String() string {
+	return strings.Join(*t, ", ")
+}
+
+func (t *tabFiles) Set(path string) error {
+	*t = append(*t, path)
+	return nil
+}
+
+// tabName returns how a -f table is named in messages.
+func tabName(path string) string {
+	if path == "-" {
+		return "<stdin>"
+	}
+	return path
+}
+
+// tabNames names all the -f tables and any -d directory for messages.
+func tabNames() string {
+	names := make([]string, 0, len(tabs)+1)
+	for _, path := range tabs {
+		names = append(names, tabName(path))
+	}
+	if *tabDir != "" {
+		names = append(names, *tabDir)
+	}
+	return strings.Join(names, ", ")
+}
+
+// fetchedTab is a table last fetched from a URL, kept so it
+// is only downloaded again if it has changed.
+type fetchedTab struct {
+	etag         string
+	lastModified string
+	data         []byte
+}
+
+// fetchedTabs are only used by loadJobs, so need no locking.
+var fetchedTabs = make(map[string]*fetchedTab)
+
+// fetchTab fetches a -f table given as an http or https URL.
+func fetchTab(url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	cached := fetchedTabs[url]
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+	client := &http.Client{Timeout: *fetchTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return cached.data, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %s", url, err)
+	}
+	fetchedTabs[url] = &fetchedTab{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		data:         data,
+	}
+	return data, nil
+}
+
+// readTab reads a -f table, from stdin if path is "-", or
+// over HTTP if it is a URL.
+func readTab(path string) ([]byte, error) {
+	if IsTabURL(path) {
+		return fetchTab(path)
+	}
+	if path != "-" {
+		return ioutil.ReadFile(path)
+	}
+	if stdinTab == nil {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		stdinTab = data
+	}
+	return stdinTab, nil
+}
+
+// loadJobs reads and parses the tables given by -f.
+func loadJobs() ([]*Job, error) {
+	limit, err := ParseByteSize(*outputLimit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -output-limit: %s", err)
+	}
+	seed := *splaySeed
+	if seed == "" {
+		seed, err = os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("error getting hostname for -splay-seed: %s", err)
+		}
+	}
+	paths := append([]string{}, tabs...)
+	if *tabDir != "" {
+		// Listed each time, so reloading picks up added and removed files.
+		dirPaths, err := ListTabDir(*tabDir)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, dirPaths...)
+	}
+	parsed := make([]Tab, 0, len(paths))
+	for _, path := range paths {
+		data, err := readTab(path)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, Tab{Name: tabName(path), Data: string(data)})
+	}
+	included := []string{}
+	jobs, err := ParseTabsWithOptions(parsed, ParseOptions{
+		Seconds:       *seconds,
+		MaxJitter:     *maxJitter,
+		Timeout:       *defaultTimeout,
+		LogDir:        *logDir,
+		LogTimestamps: *logTimestamps,
+		PrefixOutput:  *prefixOutput,
+		OutputLimit:   limit,
+		DayAnd:        *dayAnd,
+		Splay:         *splay,
+		SplaySeed:     seed,
+		ExpandEnv:     *expandEnv,
+		StrictEnv:     *strictEnv,
+		MinInterval:   *minInterval,
+		Warn: func(msg string) {
+			logEvent("warn", "parse_warning", nil, "%s", msg)
+		},
+		Included: func(path string) {
+			included = append(included, path)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	setIncludedPaths(included)
+	return jobs, nil
+}
+
+// jobTickInterval is how often jobs need to be checked.
+func jobTickInterval(jobs []*Job) time.Duration {
+	for _, j := range jobs {
+		if j.Second != 0 {
+			return time.Second
+		}
+	}
+	return time.Minute
+}
+
+// initJobMetrics creates the metrics of a job so they are exported
+// before it first runs, carrying on from any remembered state.
+func initJobMetrics(name string) {
+	overdueCounter.WithLabelValues(name)
+	failureCounter.WithLabelValues(name)
+	consecutiveFailuresGauge.WithLabelValues(name)
+	successCounter.WithLabelValues(name)
+	durationGauge.WithLabelValues(name)
+	maxrssBytesGauge.WithLabelValues(name)
+	utimeGauge.WithLabelValues(name)
+	stimeGauge.WithLabelValues(name)
+	runningGauge.WithLabelValues(name)
+	runningSecondsGauge.WithLabelValues(name)
+	currentRunStartGauge.WithLabelValues(name)
+	retryCounter.WithLabelValues(name)
+	startErrorCounter.WithLabelValues(name)
+	skippedDependencyCounter.WithLabelValues(name)
+	skippedFlagFileCounter.WithLabelValues(name)
+	slowCounter.WithLabelValues(name)
+	timeoutCounter.WithLabelValues(name)
+	restartCounter.WithLabelValues(name)
+	jitterGauge.WithLabelValues(name)
+	scheduleDriftGauge.WithLabelValues(name)
+	outputBytesCounter.WithLabelValues(name)
+	lastRunGauge.WithLabelValues(name)
+	lastSuccessGauge.WithLabelValues(name)
+
+	if state == nil {
+		return
+	}
+	js := state.Job(name)
+	successCounter.WithLabelValues(name).Add(float64(js.Successes))
+	failureCounter.WithLabelValues(name).Add(float64(js.Failures))
+	consecutiveFailuresGauge.WithLabelValues(name).Set(float64(js.ConsecutiveFailures))
+	if !js.LastRun.IsZero() {
+		lastRunGauge.WithLabelValues(name).Set(float64(js.LastRun.Unix()))
+	}
+	if !js.LastSuccess.IsZero() {
+		lastSuccessGauge.WithLabelValues(name).Set(float64(js.LastSuccess.Unix()))
+	}
+}
+
+// setJobEnabled exports whether the job is disabled.
+func setJobEnabled(j *Job) {
+	if j.Disabled {
+		enabledGauge.WithLabelValues(j.Name).Set(0)
+	} else {
+		enabledGauge.WithLabelValues(j.Name).Set(1)
+	}
+}
+
+// deleteJobMetrics removes the metrics of a job that is no longer in the table.
+func deleteJobMetrics(name string) {
+	for _, vec := range []interface{ DeleteLabelValues(...string) bool }{
+		overdueCounter,
+		failureCounter,
+		consecutiveFailuresGauge,
+		successCounter,
+		durationGauge,
+		maxrssBytesGauge,
+		utimeGauge,
+		stimeGauge,
+		runningGauge,
+		runningSecondsGauge,
+		currentRunStartGauge,
+		retryCounter,
+		startErrorCounter,
+		skippedDependencyCounter,
+		skippedFlagFileCounter,
+		slowCounter,
+		timeoutCounter,
+		restartCounter,
+		jitterGauge,
+		scheduleDriftGauge,
+		outputBytesCounter,
+		enabledGauge,
+		lastRunGauge,
+		lastSuccessGauge,
+	} {
+		vec.DeleteLabelValues(name)
+	}
+}
+
+// replaceJobs switches from the old jobs to the new ones. Jobs that are
+// in both keep their metrics, added jobs get new metrics, and removed jobs
+// lose theirs. Old jobs that are still running are added to retired, and
+// keep their metrics until pruneRetired sees them finish.
+func replaceJobs(old, retired, new []*Job) []*Job {
+	known := make(map[string]bool)
+	for _, j := range old {
+		known[j.Name] = true
+	}
+	for _, j := range retired {
+		known[j.Name] = true
+	}
+	current := make(map[string]bool)
+	for _, j := range new {
+		current[j.Name] = true
+		if !known[j.Name] {
+			initJobMetrics(j.Name)
+		}
+		setJobEnabled(j)
+	}
+	for _, j := range old {
+		if j.IsRunning() {
+			retired = append(retired, j)
+		} else if !current[j.Name] {
+			deleteJobMetrics(j.Name)
+		}
+	}
+	return retired
+}
+
+// pruneRetired drops the retired jobs that have finished, deleting
+// their metrics if they are no longer in the table.
+func pruneRetired(jobs, retired []*Job) []*Job {
+	current := make(map[string]bool)
+	for _, j := range jobs {
+		current[j.Name] = true
+	}
+	var running []*Job
+	for _, j := range retired {
+		if j.IsRunning() {
+			running = append(running, j)
+			continue
+		}
+		if !current[j.Name] && !retiredRunning(retired, j.Name) {
+			deleteJobMetrics(j.Name)
+		}
+	}
+	return running
+}
+
+// retiredRunning reports whether a retired job with the given name
+// is still running.
+func retiredRunning(retired []*Job, name string) bool {
+	for _, j := range retired {
+		if j.Name == name && j.IsRunning() {
+			return true
+		}
+	}
+	return false
+}
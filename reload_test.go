@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReplaceJobs(t *testing.T) {
+	old, err := ParseJobs("test", "kept 0 * * * * true\nremoved 0 * * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, j := range old {
+		initJobMetrics(j.Name)
+	}
+	successCounter.WithLabelValues("kept").Inc()
+
+	new, err := ParseJobs("test", "kept 30 * * * * true\nadded 0 * * * * true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	retired := replaceJobs(old, nil, new)
+	if len(retired) != 0 {
+		t.Fatalf("expected no retired jobs, got %d", len(retired))
+	}
+	if n := testutil.CollectAndCount(runningGauge); n != 2 {
+		t.Fatalf("expected 2 running series, got %d", n)
+	}
+	if v := testutil.ToFloat64(successCounter.WithLabelValues("kept")); v != 1 {
+		t.Fatalf("expected kept job to keep its successes, got %v", v)
+	}
+	if successCounter.DeleteLabelValues("removed") {
+		t.Fatal("expected removed job's metrics to be deleted")
+	}
+	deleteJobMetrics("kept")
+	deleteJobMetrics("added")
+}
+
+func TestFetchTab(t *testing.T) {
+	requests, fetches := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/tab" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fetches++
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("a * * * * * true\n"))
+	}))
+	defer server.Close()
+	defer delete(fetchedTabs, server.URL+"/tab")
+
+	for i := 0; i < 2; i++ {
+		data, err := readTab(server.URL + "/tab")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "a * * * * * true\n" {
+			t.Fatalf("unexpected table %q", data)
+		}
+	}
+	if requests != 2 || fetches != 1 {
+		t.Fatalf("expected the second read to be a conditional request, got %d requests and %d fetches", requests, fetches)
+	}
+
+	_, err := readTab(server.URL + "/missing")
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected a 404 error, got %v", err)
+	}
+}
+
+func TestStdinTab(t *testing.T) {
+	defer func(saved tabFiles, stdin *os.File) {
+		tabs = saved
+		os.Stdin = stdin
+		stdinTab = nil
+	}(tabs, os.Stdin)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "crontab")
+	writeFile(t, path, "file * * * * * true\n")
+	for _, tc := range []struct {
+		tabs  tabFiles
+		stdin string
+		// The jobs loaded, or the start of the error.
+		expected string
+	}{
+		{tabFiles{"-"}, "a * * * * * true\nb 0 * * * * true\n", "a b"},
+		{tabFiles{path, "-"}, "a * * * * * true\n", "file a"},
+		{tabFiles{"-"}, "a * * * * * true\nb 61 * * * * true\n", "parse error <stdin>:2:3 "},
+	} {
+		stdinPath := filepath.Join(dir, "stdin")
+		writeFile(t, stdinPath, tc.stdin)
+		f, err := os.Open(stdinPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		os.Stdin = f
+		stdinTab = nil
+		tabs = tc.tabs
+		// Reloading gets the same table, though stdin was read to the end.
+		for i := 0; i < 2; i++ {
+			jobs, err := loadJobs()
+			var got string
+			if err != nil {
+				got = err.Error()
+			} else {
+				names := []string{}
+				for _, j := range jobs {
+					names = append(names, j.Name)
+				}
+				got = strings.Join(names, " ")
+			}
+			if !strings.HasPrefix(got, tc.expected) {
+				t.Fatalf("loading %v, expected %q, got %q", tc.tabs, tc.expected, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// runRecord is the line written to the -runlog for each finished run.
+type runRecord struct {
+	Job          string    `json:"job"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Duration     float64   `json:"duration"`
+	ExitCode     int       `json:"exit_code"`
+	MaxrssBytes  int64     `json:"maxrss_bytes"`
+	UtimeSeconds float64   `json:"utime_seconds"`
+	StimeSeconds float64   `json:"stime_seconds"`
+}
+
+var (
+	runLogMu sync.Mutex
+	// runLog is nil without a -runlog.
+	runLog *os.File
+)
+
+func openRunLog(path string) error {
+	f, err := openLogFile(path)
+	if err != nil {
+		return err
+	}
+	runLog = f
+	return nil
+}
+
+// writeRunLog appends r to the -runlog as a line of JSON.
+func writeRunLog(r *runRecord) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("error encoding run log record: %s", err)
+		return
+	}
+	line = append(line, '\n')
+	runLogMu.Lock()
+	defer runLogMu.Unlock()
+	_, err = runLog.Write(line)
+	if err != nil {
+		log.Printf("error writing run log: %s", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "runs.log")
+	err := openRunLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		runLog.Close()
+		runLog = nil
+	}()
+	cases := []struct {
+		command  string
+		exitCode int
+	}{
+		{"true", 0},
+		{"exit 2", 2},
+	}
+	for _, tc := range cases {
+		j := &Job{Name: "runlog-test", Command: tc.command}
+		initJobMetrics(j.Name)
+		dispatchJob(j, time.Time{}, 0, 0, make(chan struct{}))
+		j.Wait()
+		deleteJobMetrics(j.Name)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != len(cases) {
+		t.Fatalf("expected a line per run, got %q", data)
+	}
+	for i, tc := range cases {
+		var r runRecord
+		err := json.Unmarshal([]byte(lines[i]), &r)
+		if err != nil {
+			t.Fatalf("expected a JSON line, got %q: %s", lines[i], err)
+		}
+		if r.Job != "runlog-test" || r.ExitCode != tc.exitCode {
+			t.Fatalf("running %q, expected job runlog-test with exit code %d, got %+v", tc.command, tc.exitCode, r)
+		}
+		if r.End.Before(r.Start) || math.Abs(r.Duration-r.End.Sub(r.Start).Seconds()) > 1e-6 || r.MaxrssBytes <= 0 {
+			t.Fatalf("running %q, unexpected times or usage %+v", tc.command, r)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !darwin
+// +build !darwin
+
+package main
+
+// maxrssUnit is the unit of Rusage.Maxrss in bytes, linux and the BSDs
+// report kilobytes.
+const maxrssUnit = 1024
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// State is what promcron remembers across restarts
+// when given a -state-file.
+type State struct {
+	mu   sync.Mutex
+	path string
+	// LastCheck is the time of the last scheduler check.
+	LastCheck time.Time            `json:"last_check"`
+	Jobs      map[string]*JobState `json:"jobs"`
+}
+
+// JobState is what is remembered about each job by name.
+type JobState struct {
+	Successes   uint64    `json:"successes"`
+	Failures    uint64    `json:"failures"`
+	LastRun     time.Time `json:"last_run"`
+	LastSuccess time.Time `json:"last_success"`
+	// ConsecutiveFailures counts failures since the last success.
+	ConsecutiveFailures uint64 `json:"consecutive_failures"`
+}
+
+// LoadState reads the state saved at path. A state is always returned so
+// the caller may carry on after an error, it is empty if the file is
+// missing or can't be read.
+func LoadState(path string) (*State, error) {
+	s := &State{path: path, Jobs: make(map[string]*JobState)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(data, s)
+	if err != nil {
+		return &State{path: path, Jobs: make(map[string]*JobState)}, err
+	}
+	if s.Jobs == nil {
+		s.Jobs = make(map[string]*JobState)
+	}
+	return s, nil
+}
+
+func (s *State) SetLastCheck(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LastCheck = t
+}
+
+// Job returns a copy of what is remembered about the named job.
+func (s *State) Job(name string) JobState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if js, ok := s.Jobs[name]; ok {
+		return *js
+	}
+	return JobState{}
+}
+
+// RecordExit remembers a run of the named job that finished at t.
+func (s *State) RecordExit(name string, t time.Time, success bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	js, ok := s.Jobs[name]
+	if !ok {
+		js = &JobState{}
+		s.Jobs[name] = js
+	}
+	js.LastRun = t
+	if success {
+		js.Successes++
+		js.LastSuccess = t
+		js.ConsecutiveFailures = 0
+	} else {
+		js.Failures++
+		js.ConsecutiveFailures++
+	}
+}
+
+// Save atomically replaces the state file, so a crash
+// never leaves it partially written.
+func (s *State) Save() error {
+	s.mu.Lock()
+	data, err := json.Marshal(s)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+// writeFileAtomic writes data to a temporary file next to path
+// then renames it into place, so readers never see a partial file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
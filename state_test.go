@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// minutesAfter is n minutes after start, or the zero time if n is -1.
+func minutesAfter(start time.Time, n int) time.Time {
+	if n < 0 {
+		return time.Time{}
+	}
+	return start.Add(time.Duration(n) * time.Minute)
+}
+
+func TestStatePersistsJobs(t *testing.T) {
+	defer func(saved *State) { state = saved }(state)
+	path := filepath.Join(t.TempDir(), "state")
+	start := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name      string
+		exits     []bool
+		successes uint64
+		failures  uint64
+		// In a row, and the minutes after start of the last run and
+		// last success, -1 for none.
+		consecutive uint64
+		lastRun     int
+		lastSuccess int
+	}{
+		{"state-never", nil, 0, 0, 0, -1, -1},
+		{"state-ok", []bool{true, true}, 2, 0, 0, 1, 1},
+		{"state-failing", []bool{true, false, false}, 1, 2, 2, 2, 0},
+		{"state-recovered", []bool{false, true}, 1, 1, 0, 1, 1},
+	} {
+		s, err := LoadState(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, success := range tc.exits {
+			s.RecordExit(tc.name, start.Add(time.Duration(i)*time.Minute), success)
+		}
+		err = s.Save()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// As if promcron was restarted.
+		state, err = LoadState(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		js := state.Job(tc.name)
+		if js.Successes != tc.successes || js.Failures != tc.failures || js.ConsecutiveFailures != tc.consecutive {
+			t.Fatalf("%s: unexpected counts %+v", tc.name, js)
+		}
+		if !js.LastRun.Equal(minutesAfter(start, tc.lastRun)) || !js.LastSuccess.Equal(minutesAfter(start, tc.lastSuccess)) {
+			t.Fatalf("%s: unexpected times %+v", tc.name, js)
+		}
+		initJobMetrics(tc.name)
+		if v := testutil.ToFloat64(successCounter.WithLabelValues(tc.name)); v != float64(tc.successes) {
+			t.Fatalf("%s: expected the success count to carry on from %d, got %v", tc.name, tc.successes, v)
+		}
+		if v := testutil.ToFloat64(failureCounter.WithLabelValues(tc.name)); v != float64(tc.failures) {
+			t.Fatalf("%s: expected the failure count to carry on from %d, got %v", tc.name, tc.failures, v)
+		}
+		deleteJobMetrics(tc.name)
+	}
+
+	// An unusable file is reported, but still gives an empty state.
+	err := ioutil.WriteFile(path, []byte("{not json"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := LoadState(path)
+	if err == nil || s == nil || len(s.Jobs) != 0 {
+		t.Fatalf("expected an error and an empty state, got %v and %+v", err, s)
+	}
+}
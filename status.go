@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// statusMu guards currentJobs and lastExitStatus, which
+	// the scheduler shares with the /jobs endpoint.
+	statusMu       sync.Mutex
+	currentJobs    []*Job
+	lastExitStatus = make(map[string]int)
+)
+
+func setCurrentJobs(jobs []*Job) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	currentJobs = jobs
+}
+
+func recordExitStatus(jobName string, exitStatus int) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	lastExitStatus[jobName] = exitStatus
+}
+
+// lastSucceeded reports whether the last run of the named job succeeded,
+// going by the state file for jobs that haven't run since promcron started.
+func lastSucceeded(jobName string) bool {
+	statusMu.Lock()
+	exitStatus, ok := lastExitStatus[jobName]
+	statusMu.Unlock()
+	if ok {
+		return exitStatus == 0
+	}
+	if state == nil {
+		return false
+	}
+	js := state.Job(jobName)
+	return !js.LastRun.IsZero() && js.LastSuccess.Equal(js.LastRun)
+}
+
+// unhealthyJobs names the current jobs whose last run failed, or that
+// have never succeeded, for -fail-if-unhealthy. Disabled and @keepalive
+// jobs are left out, as they aren't expected to finish successfully.
+func unhealthyJobs() []string {
+	statusMu.Lock()
+	jobs := currentJobs
+	statusMu.Unlock()
+	var names []string
+	for _, j := range jobs {
+		if j.Disabled || j.KeepAlive {
+			continue
+		}
+		if !lastSucceeded(j.Name) {
+			names = append(names, j.Name)
+		}
+	}
+	return names
+}
+
+// jobStatus is how a job is described by the /jobs endpoint.
+type jobStatus struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	Command  string `json:"command"`
+	// Description is omitted for jobs without one.
+	Description string `json:"description,omitempty"`
+	Enabled     bool   `json:"enabled"`
+	Running     bool   `json:"running"`
+	// LastExitStatus is nil until the job has finished a run.
+	LastExitStatus *int `json:"last_exit_status"`
+	// NextRun is nil if the job won't run within -next-horizon.
+	NextRun *time.Time `json:"next_run"`
+	// Timeout is from @timeout or -default-timeout, omitted if there is none.
+	Timeout float64 `json:"timeout_seconds,omitempty"`
+}
+
+func jobStatuses(now time.Time) []jobStatus {
+	statusMu.Lock()
+	jobs := currentJobs
+	exitStatuses := make(map[string]int, len(lastExitStatus))
+	for name, exitStatus := range lastExitStatus {
+		exitStatuses[name] = exitStatus
+	}
+	statusMu.Unlock()
+
+	statuses := make([]jobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		s := jobStatus{
+			Name:        j.Name,
+			Schedule:    j.Schedule,
+			Command:     j.Command,
+			Description: j.Description,
+			Enabled:     !j.Disabled,
+			Running:     j.IsRunning(),
+			Timeout:     j.Timeout.Seconds(),
+		}
+		if exitStatus, ok := exitStatuses[j.Name]; ok {
+			s.LastExitStatus = &exitStatus
+		}
+		if next, ok := j.NextRun(now, now.Add(*nextHorizon)); ok {
+			s.NextRun = &next
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// logStatus logs the status of each job, on SIGUSR1.
+func logStatus() {
+	statuses := jobStatuses(time.Now())
+	logEvent("info", "status", logFields{"jobs": len(statuses)}, "status of %d jobs:", len(statuses))
+	for _, s := range statuses {
+		lastExitStatus := "none"
+		if s.LastExitStatus != nil {
+			lastExitStatus = strconv.Itoa(*s.LastExitStatus)
+		}
+		timeout := "none"
+		if s.Timeout != 0 {
+			timeout = time.Duration(s.Timeout * float64(time.Second)).String()
+		}
+		fields := logFields{
+			"job":              s.Name,
+			"schedule":         s.Schedule,
+			"enabled":          s.Enabled,
+			"running":          s.Running,
+			"last_exit_status": s.LastExitStatus,
+			"timeout":          s.Timeout,
+		}
+		logEvent("info", "job_status", fields, "job %s: schedule %q, enabled %t, running %t, last exit status %s, timeout %s",
+			s.Name, s.Schedule, s.Enabled, s.Running, lastExitStatus, timeout)
+	}
+}
+
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(jobStatuses(time.Now()))
+	if err != nil {
+		log.Printf("error writing job status: %s", err)
+	}
+}
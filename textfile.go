@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// textfileMu keeps concurrent job exits from writing
+// an older set of metrics over a newer one.
+var textfileMu sync.Mutex
+
+// writeTextfile writes promcron's own metrics to path in the text
+// exposition format for the node_exporter textfile collector. The Go
+// runtime and process metrics are left out as they would clash with
+// node_exporter's own.
+func writeTextfile(path string) error {
+	textfileMu.Lock()
+	defer textfileMu.Unlock()
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	for _, mf := range mfs {
+		if !strings.HasPrefix(mf.GetName(), "promcron_") {
+			continue
+		}
+		_, err := expfmt.MetricFamilyToText(buf, mf)
+		if err != nil {
+			return err
+		}
+	}
+	// node_exporter may be running as another user.
+	return writeFileAtomic(path, buf.Bytes(), 0644)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteTextfile(t *testing.T) {
+	name := "textfile-test"
+	initJobMetrics(name)
+	defer deleteJobMetrics(name)
+	successCounter.WithLabelValues(name).Add(2)
+
+	path := filepath.Join(t.TempDir(), "promcron.prom")
+	err := writeTextfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		line     string
+		included bool
+	}{
+		{`promcron_job_success_count{job="textfile-test"} 2`, true},
+		{"# TYPE promcron_job_success_count counter", true},
+		// These would clash with node_exporter's own.
+		{"go_goroutines", false},
+		{"process_cpu_seconds_total", false},
+	} {
+		if strings.Contains(string(data), tc.line) != tc.included {
+			t.Fatalf("expected %q included %v, got:\n%s", tc.line, tc.included, data)
+		}
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0644 {
+		t.Fatalf("expected the file to be readable by node_exporter, got mode %s", st.Mode())
+	}
+	leftovers, _ := filepath.Glob(path + ".tmp*")
+	if len(leftovers) != 0 {
+		t.Fatalf("expected no temporary files left, got %v", leftovers)
+	}
+}
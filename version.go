@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Set at build time with:
+//
+//	go build -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// versionString is what -version prints.
+func versionString() string {
+	return fmt.Sprintf("promcron %s (commit %s, built %s)", version, commit, buildDate)
+}
+
+var buildInfo = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "promcron_build_info",
+		Help: "A metric with a constant '1' value labeled by the version, commit and build date promcron was built from.",
+	},
+	[]string{"version", "commit", "build_date", "goversion"},
+)
+
+func init() {
+	buildInfo.WithLabelValues(version, commit, buildDate, runtime.Version()).Set(1)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestVersion(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	if v := testutil.ToFloat64(buildInfo.WithLabelValues(version, commit, buildDate, runtime.Version())); v != 1 {
+		t.Fatalf("expected build info for the defaults to be 1, got %v", v)
+	}
+	for _, tc := range []struct {
+		version, commit, buildDate string
+		expected                   string
+	}{
+		{"dev", "unknown", "unknown", "promcron dev (commit unknown, built unknown)"},
+		{"v1.2.0", "abc123", "2021-06-01", "promcron v1.2.0 (commit abc123, built 2021-06-01)"},
+	} {
+		version, commit, buildDate = tc.version, tc.commit, tc.buildDate
+		if s := versionString(); s != tc.expected {
+			t.Fatalf("expected %q, got %q", tc.expected, s)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchInterval is how long -watch waits after the last change to the
+// tables before reloading, so a table being written isn't loaded half
+// done and a burst of changes only reloads once.
+var watchInterval = time.Second
+
+// includedPaths are the files and directories named by @include and
+// @includedir when the tables were last loaded, so they are watched too.
+var (
+	includedPathsMu sync.Mutex
+	includedPaths   []string
+	// includesChanged tells the watcher to watch the new includedPaths.
+	includesChanged = make(chan struct{}, 1)
+)
+
+func setIncludedPaths(paths []string) {
+	includedPathsMu.Lock()
+	includedPaths = paths
+	includedPathsMu.Unlock()
+	select {
+	case includesChanged <- struct{}{}:
+	default:
+	}
+}
+
+// tabWatcher requests a reload when a local -f table, a file in the -d
+// directory, or a file they include changes on disk. It watches the
+// directories holding them rather than the files, so a table replaced by
+// renaming another file over it, as many editors do, stays watched.
+type tabWatcher struct {
+	w *fsnotify.Watcher
+	// files are the tables and included files, dirs the directories
+	// whose files are all tables, and watching what w watches.
+	files    map[string]bool
+	dirs     map[string]bool
+	watching map[string]bool
+}
+
+func newTabWatcher() (*tabWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	t := &tabWatcher{w: w, watching: make(map[string]bool)}
+	t.update()
+	return t, nil
+}
+
+// update watches the current tables and includes, and stops watching
+// directories that no longer hold any.
+func (t *tabWatcher) update() {
+	t.files = make(map[string]bool)
+	t.dirs = make(map[string]bool)
+	for _, path := range tabs {
+		if path != "-" && !IsTabURL(path) {
+			t.files[filepath.Clean(path)] = true
+		}
+	}
+	if *tabDir != "" {
+		t.dirs[filepath.Clean(*tabDir)] = true
+	}
+	includedPathsMu.Lock()
+	for _, path := range includedPaths {
+		// Until an @includedir directory exists, creating it is the change.
+		if st, err := os.Stat(path); err == nil && st.IsDir() {
+			t.dirs[filepath.Clean(path)] = true
+		} else {
+			t.files[filepath.Clean(path)] = true
+		}
+	}
+	includedPathsMu.Unlock()
+
+	want := make(map[string]bool)
+	for path := range t.files {
+		want[filepath.Dir(path)] = true
+	}
+	for dir := range t.dirs {
+		want[dir] = true
+	}
+	for dir := range want {
+		if t.watching[dir] {
+			continue
+		}
+		err := t.w.Add(dir)
+		if err != nil {
+			logEvent("warn", "watch_error", nil, "unable to watch %s for table changes: %s", dir, err)
+			continue
+		}
+		t.watching[dir] = true
+	}
+	for dir := range t.watching {
+		if !want[dir] {
+			t.w.Remove(dir)
+			delete(t.watching, dir)
+		}
+	}
+}
+
+// affectsTabs reports whether ev is a change to a table or included file,
+// or adds, removes or changes a file in a directory of tables.
+func (t *tabWatcher) affectsTabs(ev fsnotify.Event) bool {
+	if ev.Op == fsnotify.Chmod {
+		return false
+	}
+	name := filepath.Clean(ev.Name)
+	if t.files[name] {
+		return true
+	}
+	// Hidden files, such as editors' swap files, aren't loaded.
+	return t.dirs[filepath.Dir(name)] && !strings.HasPrefix(filepath.Base(name), ".")
+}
+
+// run requests a reload once the tables have stopped changing, until
+// done is closed.
+func (t *tabWatcher) run(done <-chan struct{}) {
+	defer t.w.Close()
+	var settled <-chan time.Time
+	for {
+		select {
+		case ev := <-t.w.Events:
+			if t.affectsTabs(ev) {
+				settled = time.After(watchInterval)
+			}
+		case err := <-t.w.Errors:
+			logEvent("warn", "watch_error", nil, "error watching tables: %s", err)
+		case <-includesChanged:
+			t.update()
+		case <-settled:
+			settled = nil
+			logEvent("info", "tab_changed", nil, "%q changed, reloading", tabNames())
+			requestReload()
+		case <-done:
+			return
+		}
+	}
+}
+
+// watchTabs requests a reload whenever the tables change on disk,
+// until done is closed.
+func watchTabs(done <-chan struct{}) {
+	t, err := newTabWatcher()
+	if err != nil {
+		logEvent("error", "watch_error", nil, "unable to watch tables for changes: %s", err)
+		return
+	}
+	t.run(done)
+}
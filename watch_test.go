@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startTabWatcher runs w until the test ends, once any stale reload
+// request has been drained.
+func startTabWatcher(t *testing.T, w *tabWatcher) {
+	select {
+	case <-reloadRequests:
+	default:
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		<-stopped
+	})
+	go func() {
+		w.run(done)
+		close(stopped)
+	}()
+}
+
+func expectReload(t *testing.T, what string) {
+	select {
+	case <-reloadRequests:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected %s to request a reload", what)
+	}
+}
+
+func expectNoReload(t *testing.T, what string) {
+	select {
+	case <-reloadRequests:
+		t.Fatalf("expected no reload after %s", what)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func writeFile(t *testing.T, path, data string) {
+	err := ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchTabs(t *testing.T) {
+	defer func(saved tabFiles, interval time.Duration) {
+		tabs = saved
+		watchInterval = interval
+	}(tabs, watchInterval)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "crontab")
+	writeFile(t, path, "a * * * * * true\n")
+	tabs = tabFiles{path, "-", "http://example.com/crontab"}
+	watchInterval = 10 * time.Millisecond
+
+	w, err := newTabWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(w.watching) != 1 || !w.watching[dir] {
+		t.Fatalf("expected only %s to be watched, got %v", dir, w.watching)
+	}
+	startTabWatcher(t, w)
+	expectNoReload(t, "no change")
+	writeFile(t, filepath.Join(dir, "other"), "not a table\n")
+	expectNoReload(t, "writing another file in the directory")
+
+	writeFile(t, path, "b * * * * * true\n")
+	expectReload(t, "writing the table")
+
+	// Replace the table by renaming over it, as editors do. The
+	// directory is watched, so the table still is afterwards.
+	replacement := filepath.Join(dir, "crontab.new")
+	writeFile(t, replacement, "c * * * * * true\n")
+	err = os.Rename(replacement, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReload(t, "renaming over the table")
+	writeFile(t, path, "d * * * * * true\n")
+	expectReload(t, "writing the replaced table")
+
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReload(t, "removing the table")
+}
+
+func TestWatchIncludes(t *testing.T) {
+	defer func(saved tabFiles, interval time.Duration) {
+		tabs = saved
+		watchInterval = interval
+		setIncludedPaths(nil)
+	}(tabs, watchInterval)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "crontab")
+	included := filepath.Join(dir, "base")
+	includedDir := filepath.Join(dir, "promcron.d")
+	err := os.Mkdir(includedDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, "@include base\n@includedir promcron.d\n")
+	writeFile(t, included, "a * * * * * true\n")
+	writeFile(t, filepath.Join(includedDir, "b"), "b * * * * * true\n")
+	tabs = tabFiles{path}
+	watchInterval = 10 * time.Millisecond
+	jobs, err := loadJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("expected the included jobs to load, got %d jobs", len(jobs))
+	}
+
+	w, err := newTabWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.files[included] || !w.dirs[includedDir] || !w.watching[includedDir] {
+		t.Fatalf("expected the included file and directory to be watched, got %v, %v and %v", w.files, w.dirs, w.watching)
+	}
+	startTabWatcher(t, w)
+	writeFile(t, included, "a * * * * * false\n")
+	expectReload(t, "editing an included file")
+	writeFile(t, filepath.Join(includedDir, "c"), "c * * * * * true\n")
+	expectReload(t, "adding a file to an included directory")
+	writeFile(t, filepath.Join(includedDir, ".c.swp"), "swap\n")
+	expectNoReload(t, "writing a hidden file in an included directory")
+}